@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errHostNotFound = errors.New("Host config not found")
+
+// GET/PUT/DELETE /api/hosts/{pattern}, where pattern identifies the host config
+// (its host, followed by its restrictions if it has any, e.g. .example.com;path=/api/*)
+func (a *Architeuthis) handleHostsApi(w http.ResponseWriter, r *http.Request) {
+
+	pattern := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/hosts"), "/")
+
+	var result interface{}
+	var err error
+
+	switch {
+	case r.Method == http.MethodGet && pattern == "":
+		result, err = a.getRawHosts()
+	case r.Method == http.MethodGet:
+		result, err = a.getRawHost(pattern)
+	case r.Method == http.MethodPut && pattern != "":
+		var entry map[string]interface{}
+		err = json.NewDecoder(r.Body).Decode(&entry)
+		if err != nil || entry == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprint(w, "Expected a host config (JSON object)\n")
+			return
+		}
+		result, err = a.putRawHost(pattern, entry)
+	case r.Method == http.MethodDelete && pattern != "":
+		err = a.deleteRawHost(pattern)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err == errHostNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = fmt.Fprintf(w, "%s\n", err.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintf(w, "%s\n", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// Config as it was written, as a JSON tree
+func rawConfigTree(cfg *Config) (map[string]interface{}, []interface{}, error) {
+
+	var root map[string]interface{}
+	err := json.Unmarshal(cfg.raw, &root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hosts, _ := root["hosts"].([]interface{})
+	return root, hosts, nil
+}
+
+// Same as HostConfig.key(), for a host config as it was written
+func rawHostKey(entry interface{}) string {
+
+	entryBytes, _ := json.Marshal(entry)
+
+	conf := &HostConfig{}
+	if json.Unmarshal(entryBytes, conf) != nil {
+		return ""
+	}
+	conf.Method = strings.ToUpper(conf.Method)
+	conf.Scheme = strings.ToLower(conf.Scheme)
+	return conf.key()
+}
+
+func findRawHost(hosts []interface{}, pattern string) int {
+	for i, entry := range hosts {
+		if rawHostKey(entry) == pattern {
+			return i
+		}
+	}
+	return -1
+}
+
+func (a *Architeuthis) getRawHosts() ([]interface{}, error) {
+
+	_, hosts, err := rawConfigTree(getConfig())
+	if err != nil {
+		return nil, err
+	}
+	if hosts == nil {
+		hosts = []interface{}{}
+	}
+	return hosts, nil
+}
+
+func (a *Architeuthis) getRawHost(pattern string) (interface{}, error) {
+
+	_, hosts, err := rawConfigTree(getConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	i := findRawHost(hosts, pattern)
+	if i < 0 {
+		return nil, errHostNotFound
+	}
+	return hosts[i], nil
+}
+
+// Replaces the host config, or adds it after the existing ones (as the most specific)
+func (a *Architeuthis) putRawHost(pattern string, entry map[string]interface{}) (interface{}, error) {
+
+	if _, ok := entry["host"]; !ok && !strings.Contains(pattern, ";") {
+		entry["host"] = pattern
+	}
+	if key := rawHostKey(entry); key != pattern {
+		return nil, errors.Errorf("Host config doesn't match '%s' (got '%s')", pattern, key)
+	}
+
+	err := a.updateRawHosts(func(hosts []interface{}) ([]interface{}, error) {
+		if i := findRawHost(hosts, pattern); i >= 0 {
+			hosts[i] = entry
+			return hosts, nil
+		}
+		return append(hosts, entry), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (a *Architeuthis) deleteRawHost(pattern string) error {
+	return a.updateRawHosts(func(hosts []interface{}) ([]interface{}, error) {
+		i := findRawHost(hosts, pattern)
+		if i < 0 {
+			return nil, errHostNotFound
+		}
+		return append(hosts[:i], hosts[i+1:]...), nil
+	})
+}
+
+// Applies a change to the host configs. The new config goes through the same
+// validation as the config file, it is only activated (and saved) if it is valid
+func (a *Architeuthis) updateRawHosts(update func(hosts []interface{}) ([]interface{}, error)) error {
+
+	a.apiMu.Lock()
+	defer a.apiMu.Unlock()
+
+	root, hosts, err := rawConfigTree(getConfig())
+	if err != nil {
+		return err
+	}
+
+	hosts, err = update(hosts)
+	if err != nil {
+		return err
+	}
+	root["hosts"] = hosts
+
+	rawBytes, err := json.Marshal(root)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadConfigBytes(rawBytes)
+	if err != nil {
+		return err
+	}
+
+	err = a.activateConfig(cfg, "api")
+	if err != nil {
+		return err
+	}
+
+	if cfg.SaveApiChanges {
+		hash, err := writeConfigFile(root)
+		if err != nil {
+			logrus.WithError(err).Error("Could not save config file")
+			return errors.Wrap(err, "Config was updated but could not be saved")
+		}
+		// The watcher must not activate the config again
+		a.setLocalConfigHash(hash)
+	}
+	return nil
+}
+
+// Replaces the config file and returns the hash of the new file. Comments and
+// formatting are not preserved
+func writeConfigFile(root map[string]interface{}) (string, error) {
+
+	var configBytes []byte
+	var err error
+	if isYamlFile(configPath) {
+		configBytes, err = yaml.Marshal(root)
+	} else {
+		configBytes, err = json.MarshalIndent(root, "", "  ")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(configPath), ".config")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(configBytes)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if info, err := os.Stat(configPath); err == nil {
+		_ = os.Chmod(tmpFile.Name(), info.Mode())
+	}
+	err = os.Rename(tmpFile.Name(), configPath)
+	if err != nil {
+		return "", err
+	}
+
+	// Same as loadConfig
+	decoded, err := decodeConfigFile(configBytes, isYamlFile(configPath))
+	if err != nil {
+		return "", err
+	}
+	return configHash(decoded), nil
+}
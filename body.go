@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"github.com/ryanuber/go-glob"
+	"io"
+	"io/ioutil"
+	"mime"
+)
+
+const DefaultBodyInspectSize = 1024 * 1024
+
+var DefaultBodyInspectTypes = []string{
+	"text/*",
+	"application/json",
+	"application/*+json",
+	"application/xml",
+	"application/*+xml",
+	"application/javascript",
+}
+
+// Body that replays the inspected prefix before the rest of the original body
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Returns the first bytes of the response body, as configured for this host.
+// The body is only read once and shared between all rules, the rest is
+// streamed to the client untouched.
+func (ctx *ResponseCtx) inspectBody() string {
+
+	if ctx.Response == nil {
+		return ""
+	}
+
+	if ctx.bodyInspected {
+		return string(ctx.bodyPrefix)
+	}
+	ctx.bodyInspected = true
+
+	size := int64(DefaultBodyInspectSize)
+	types := DefaultBodyInspectTypes
+	if ctx.RequestCtx != nil {
+		hostConfig := getMostSpecificConfig(ctx.RequestCtx.configs)
+		if hostConfig.BodyInspectSize != 0 {
+			size = hostConfig.BodyInspectSize
+		}
+		if hostConfig.BodyInspectTypes != nil {
+			types = hostConfig.BodyInspectTypes
+		}
+	}
+
+	if size < 0 || !shouldInspectContentType(ctx.Response.Header.Get("Content-Type"), types) {
+		return ""
+	}
+
+	body := ctx.Response.Body
+	prefix, err := ioutil.ReadAll(io.LimitReader(body, size))
+	if err != nil {
+		handleRuleErr(err)
+	}
+	ctx.bodyPrefix = prefix
+
+	ctx.Response.Body = &prefixedBody{
+		Reader: io.MultiReader(bytes.NewReader(ctx.bodyPrefix), body),
+		Closer: body,
+	}
+
+	return string(ctx.bodyPrefix)
+}
+
+func shouldInspectContentType(contentType string, types []string) bool {
+
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+
+	for _, t := range types {
+		if glob.Glob(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-redis/redis/v7"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+// Redis keys of the cluster-wide config
+const KeyConfigVersion = "config:version"
+const KeyConfigCounter = "config:counter"
+const KeyConfigHistory = "config:history"
+const PrefixConfig = "config:v:"
+
+// Pub/sub channel, new versions are published on it
+const ChannelConfig = "config"
+
+// Number of versions kept in the history
+const ConfigHistorySize = 50
+
+type configHistoryEntry struct {
+	Version int64     `json:"version"`
+	Hash    string    `json:"hash"`
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Active  bool      `json:"active"`
+}
+
+// Shares the config with the other instances through Redis. The active version is
+// loaded if there is one, otherwise the local config becomes the first version
+func (a *Architeuthis) setupClusterConfig() error {
+
+	a.clusterConfig = true
+
+	// Subscribe first, so that no version is missed
+	pubsub := a.redis.Subscribe(ChannelConfig)
+	_, err := pubsub.Receive()
+	if err != nil {
+		return err
+	}
+
+	version, err := a.redis.Get(KeyConfigVersion).Int64()
+	if err == redis.Nil {
+		err = a.publishConfig(getConfig(), "file")
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		err = a.loadClusterConfig(version)
+		if err != nil {
+			logrus.WithError(err).WithField("version", version).Error("Could not load cluster config, using the local config")
+		}
+	}
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			version, err := strconv.ParseInt(msg.Payload, 10, 64)
+			if err != nil {
+				continue
+			}
+			err = a.loadClusterConfig(version)
+			if err != nil {
+				logrus.WithError(err).WithField("version", version).Error("Could not load cluster config, keeping the current config")
+			}
+		}
+	}()
+
+	logrus.WithFields(logrus.Fields{
+		"version": getConfig().Version,
+	}).Info("Using cluster config")
+	return nil
+}
+
+func (a *Architeuthis) loadClusterConfig(version int64) error {
+
+	if version <= getConfig().Version {
+		return nil
+	}
+
+	rawBytes, err := a.redis.Get(PrefixConfig + strconv.FormatInt(version, 10)).Bytes()
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadConfigBytes(rawBytes)
+	if err != nil {
+		return err
+	}
+	cfg.Version = version
+
+	a.swapConfig(cfg)
+	return nil
+}
+
+// Allocates the version, stores the config, makes it the active version and
+// publishes it in a single step, so that concurrent publications can't overwrite
+// config:version with an older version
+var publishConfigScript = redis.NewScript(`
+local version = redis.call("INCR", KEYS[1])
+local historySize = tonumber(ARGV[3])
+
+redis.call("SET", ARGV[4] .. version, ARGV[1])
+redis.call("SET", KEYS[2], version)
+
+local entry = cjson.decode(ARGV[2])
+entry["version"] = version
+redis.call("LPUSH", KEYS[3], cjson.encode(entry))
+if version > historySize then
+	redis.call("DEL", ARGV[4] .. (version - historySize))
+end
+redis.call("LTRIM", KEYS[3], 0, historySize - 1)
+
+redis.call("PUBLISH", ARGV[5], version)
+return version
+`)
+
+// Stores the config as a new version and notifies the other instances
+func (a *Architeuthis) publishConfig(cfg *Config, source string) error {
+
+	entry, _ := json.Marshal(configHistoryEntry{
+		Hash:   cfg.Hash,
+		Time:   time.Now(),
+		Source: source,
+	})
+
+	version, err := publishConfigScript.Run(a.redis,
+		[]string{KeyConfigCounter, KeyConfigVersion, KeyConfigHistory},
+		cfg.raw, entry, ConfigHistorySize, PrefixConfig, ChannelConfig,
+	).Int64()
+	if err != nil {
+		return err
+	}
+
+	// cfg might already be the active config, which must not be modified
+	published := *cfg
+	published.Version = version
+	a.swapConfig(&published)
+	return nil
+}
+
+func (a *Architeuthis) getConfigHistory() ([]configHistoryEntry, error) {
+
+	result, err := a.redis.LRange(KeyConfigHistory, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	active := getConfig().Version
+	history := make([]configHistoryEntry, 0, len(result))
+	for _, entryStr := range result {
+		var entry configHistoryEntry
+		if json.Unmarshal([]byte(entryStr), &entry) != nil {
+			continue
+		}
+		entry.Active = entry.Version == active
+		history = append(history, entry)
+	}
+	return history, nil
+}
+
+// Publishes a copy of a previous version as the new version
+func (a *Architeuthis) rollbackConfig(version int64) error {
+
+	rawBytes, err := a.redis.Get(PrefixConfig + strconv.FormatInt(version, 10)).Bytes()
+	if err == redis.Nil {
+		return errors.Errorf("Version %d is not in the history", version)
+	} else if err != nil {
+		return err
+	}
+
+	cfg, err := loadConfigBytes(rawBytes)
+	if err != nil {
+		return err
+	}
+
+	return a.publishConfig(cfg, "rollback:"+strconv.FormatInt(version, 10))
+}
+
+// Makes the config active, on the whole cluster in cluster mode
+func (a *Architeuthis) activateConfig(cfg *Config, source string) error {
+	if a.clusterConfig {
+		return a.publishConfig(cfg, source)
+	}
+	a.swapConfig(cfg)
+	return nil
+}
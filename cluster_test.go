@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestClusterConfigKeepsInstanceSettings(t *testing.T) {
+
+	local := useTestConfig(t, `{
+		"addr": "localhost:5050", "redis_url": "localhost:6379", "influx_url": "http://localhost:8086",
+		"timeout": "1s", "wait": "0s", "multiplier": 1, "retries": 1,
+		"hosts": [{"host": "*", "every": "1s", "burst": 1}]
+	}`)
+
+	a := &Architeuthis{clusterConfig: true}
+	if !a.setLocalConfig(local) {
+		t.Error("expected the first config file to be a change")
+	}
+
+	cluster, err := loadConfigBytes([]byte(`{
+		"addr": "other:5050", "redis_url": "other:6379", "influx_url": "http://other:8086",
+		"timeout": "1s", "wait": "0s", "multiplier": 1, "retries": 5,
+		"hosts": [{"host": "*", "every": "1s", "burst": 1}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.Version = 1
+	a.swapConfig(cluster)
+
+	cfg := getConfig()
+	if cfg.Addr != "localhost:5050" || cfg.RedisUrl != "localhost:6379" || cfg.InfluxUrl != "http://localhost:8086" {
+		t.Errorf("expected the instance settings, got %s, %s, %s", cfg.Addr, cfg.RedisUrl, cfg.InfluxUrl)
+	}
+	if cfg.DefaultConfig.Retries != 5 {
+		t.Errorf("expected the cluster config, got %d retries", cfg.DefaultConfig.Retries)
+	}
+
+	// The file didn't change, even if the active config is the cluster's
+	unchanged, err := loadConfigBytes(local.raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.setLocalConfig(unchanged) {
+		t.Error("expected the unchanged config file not to be a change")
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/ryanuber/go-glob"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Comparison operators, longest first
+var conditionOperators = []string{"!~*", "!*=", "!~", "~*", "*=", "!=", "=", "~", ">", "<"}
+
+type conditionFunc func(ctx *ResponseCtx) bool
+
+// Recursive descent parser for rule conditions:
+//
+//	or         := and ("OR" and)*
+//	and        := not ("AND" not)*
+//	not        := "NOT" not | primary
+//	primary    := "(" or ")" | comparison
+//	comparison := operand operator (quoted string | unquoted string)
+//
+// Unquoted strings run until the end of the condition, a closing parenthesis
+// or an AND/OR keyword that is followed by another condition, so that
+// conditions such as `body=*Try again in a few minutes*` keep working.
+type conditionParser struct {
+	input string
+	pos   int
+	depth int
+	// Only allow the operands that are known before the request is sent
+	requestOnly bool
+}
+
+type conditionError struct {
+	condition string
+	pos       int
+	msg       string
+}
+
+func (e *conditionError) Error() string {
+	return "Invalid rule: " + e.condition + " (at position " + strconv.Itoa(e.pos+1) + ": " + e.msg + ")"
+}
+
+func parseCondition(condition string) (conditionFunc, error) {
+	return (&conditionParser{input: condition}).parse()
+}
+
+// Conditions of request rules, which are evaluated before the request is sent
+func parseRequestCondition(condition string) (conditionFunc, error) {
+	return (&conditionParser{input: condition, requestOnly: true}).parse()
+}
+
+func (p *conditionParser) parse() (conditionFunc, error) {
+
+	matches, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return nil, p.errorf("unexpected '%s'", p.input[p.pos:])
+	}
+	return matches, nil
+}
+
+func (p *conditionParser) errorf(format string, args ...interface{}) error {
+	return &conditionError{
+		condition: p.input,
+		pos:       p.pos,
+		msg:       fmt.Sprintf(format, args...),
+	}
+}
+
+func (p *conditionParser) parseOr() (conditionFunc, error) {
+
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(ctx *ResponseCtx) bool {
+			return l(ctx) || right(ctx)
+		}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseAnd() (conditionFunc, error) {
+
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(ctx *ResponseCtx) bool {
+			return l(ctx) && right(ctx)
+		}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseNot() (conditionFunc, error) {
+
+	if p.acceptKeyword("NOT") {
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx *ResponseCtx) bool {
+			return !inner(ctx)
+		}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *conditionParser) parsePrimary() (conditionFunc, error) {
+
+	p.skipSpaces()
+	if p.pos >= len(p.input) {
+		return nil, p.errorf("expected condition")
+	}
+
+	if p.input[p.pos] == '(' {
+		p.pos++
+		p.depth++
+
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		p.skipSpaces()
+		if p.pos >= len(p.input) || p.input[p.pos] != ')' {
+			return nil, p.errorf("expected ')'")
+		}
+		p.pos++
+		p.depth--
+
+		return inner, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *conditionParser) parseComparison() (conditionFunc, error) {
+
+	start := p.pos
+	op1, err := p.readOperand()
+	if err != nil {
+		return nil, err
+	}
+	if op1 == "" {
+		return nil, p.errorf("expected operand")
+	}
+	if p.requestOnly && !isRequestOperand(op1) {
+		return nil, &conditionError{condition: p.input, pos: start,
+			msg: "'" + op1 + "' is not known before the request is sent"}
+	}
+
+	p.skipSpaces()
+	operator := p.readOperator()
+	if operator == "" {
+		return nil, p.errorf("expected operator after '%s'", op1)
+	}
+
+	p.skipSpaces()
+	valuePos := p.pos
+	var op2 string
+	if p.pos < len(p.input) && p.input[p.pos] == '"' {
+		op2, err = p.readQuoted()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		op2 = p.readUnquoted()
+	}
+
+	matches, err := makeComparison(op1, operator, op2)
+	if err != nil {
+		pos := start
+		if _, ok := err.(*operandError); !ok {
+			pos = valuePos
+		}
+		return nil, &conditionError{condition: p.input, pos: pos, msg: err.Error()}
+	}
+	return matches, nil
+}
+
+func (p *conditionParser) skipSpaces() {
+	for p.pos < len(p.input) && isSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+// Consumes the keyword if it is the next token
+func (p *conditionParser) acceptKeyword(keyword string) bool {
+
+	pos := p.pos
+	for pos < len(p.input) && isSpace(p.input[pos]) {
+		pos++
+	}
+
+	if !hasKeywordAt(p.input, pos, keyword) {
+		return false
+	}
+	p.pos = pos + len(keyword)
+	return true
+}
+
+func hasKeywordAt(input string, pos int, keyword string) bool {
+
+	if !strings.HasPrefix(input[pos:], keyword) {
+		return false
+	}
+
+	end := pos + len(keyword)
+	return end == len(input) || isSpace(input[end]) || input[end] == '('
+}
+
+// Operands can contain quoted parts, e.g. html:"div > p". Brackets are kept
+// as they are, e.g. json:$.items[0]['some key'] or html:a[title="Next page"]
+func (p *conditionParser) readOperand() (string, error) {
+
+	var sb strings.Builder
+	for p.pos < len(p.input) && !isOperandEnd(p.input[p.pos]) {
+		switch p.input[p.pos] {
+		case '"':
+			quoted, err := p.readQuoted()
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(quoted)
+		case '[':
+			bracketed, err := p.readBracketed()
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(bracketed)
+		default:
+			sb.WriteByte(p.input[p.pos])
+			p.pos++
+		}
+	}
+	return sb.String(), nil
+}
+
+// Reads [...] verbatim, quoted strings inside the brackets can contain ']'
+func (p *conditionParser) readBracketed() (string, error) {
+
+	start := p.pos
+	var quote byte
+	for p.pos++; p.pos < len(p.input); p.pos++ {
+		c := p.input[p.pos]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ']':
+			p.pos++
+			return p.input[start:p.pos], nil
+		}
+	}
+
+	p.pos = start
+	return "", p.errorf("missing ']'")
+}
+
+func isOperandEnd(c byte) bool {
+	return isSpace(c) || c == '(' || c == ')' || strings.IndexByte("=!<>~*", c) >= 0
+}
+
+func (p *conditionParser) readOperator() string {
+	for _, op := range conditionOperators {
+		if strings.HasPrefix(p.input[p.pos:], op) {
+			p.pos += len(op)
+			return op
+		}
+	}
+	return ""
+}
+
+func (p *conditionParser) readQuoted() (string, error) {
+
+	start := p.pos
+	p.pos++
+
+	var sb strings.Builder
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			return sb.String(), nil
+		case c == '\\' && p.pos+1 < len(p.input) && (p.input[p.pos+1] == '"' || p.input[p.pos+1] == '\\'):
+			sb.WriteByte(p.input[p.pos+1])
+			p.pos += 2
+		default:
+			sb.WriteByte(c)
+			p.pos++
+		}
+	}
+
+	p.pos = start
+	return "", p.errorf("unterminated string")
+}
+
+// Parentheses inside the string are kept if they are balanced, e.g. (body=(x))
+func (p *conditionParser) readUnquoted() string {
+
+	start := p.pos
+	nested := 0
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+
+		if c == '(' {
+			nested++
+		} else if c == ')' {
+			if nested == 0 && p.depth > 0 {
+				break
+			}
+			if nested > 0 {
+				nested--
+			}
+		}
+
+		if isSpace(c) && p.isValueEnd(p.pos, nested) {
+			break
+		}
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+// Whitespace ends an unquoted string if it is followed by a closing
+// parenthesis, or by AND/OR and something that looks like a condition
+func (p *conditionParser) isValueEnd(pos int, nested int) bool {
+
+	for pos < len(p.input) && isSpace(p.input[pos]) {
+		pos++
+	}
+	if pos == len(p.input) {
+		return false
+	}
+
+	if p.input[pos] == ')' && p.depth > 0 && nested == 0 {
+		return true
+	}
+
+	for _, keyword := range []string{"AND", "OR"} {
+		if hasKeywordAt(p.input, pos, keyword) {
+			return looksLikeCondition(p.input[pos+len(keyword):])
+		}
+	}
+	return false
+}
+
+func looksLikeCondition(str string) bool {
+
+	lookahead := &conditionParser{input: str}
+	lookahead.skipSpaces()
+
+	if lookahead.pos < len(str) && str[lookahead.pos] == '(' {
+		return true
+	}
+	if hasKeywordAt(str, lookahead.pos, "NOT") {
+		return true
+	}
+
+	op1, err := lookahead.readOperand()
+	lookahead.skipSpaces()
+	if err != nil {
+		return false
+	}
+	_, err = parseOperand1(op1)
+	return err == nil && lookahead.readOperator() != ""
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+type operandError struct {
+	operand string
+	err     error
+}
+
+func (e *operandError) Error() string {
+	if e.err != nil {
+		return "invalid operand '" + e.operand + "': " + e.err.Error()
+	}
+	return "invalid operand '" + e.operand + "'"
+}
+
+func makeComparison(op1Str, operator, op2Str string) (conditionFunc, error) {
+
+	op1Func, err := parseOperand1(op1Str)
+	if err != nil {
+		return nil, err
+	}
+
+	switch operator {
+	case "!=":
+		if isGlob(op2Str) {
+			return func(ctx *ResponseCtx) bool {
+				return !glob.Glob(op2Str, op1Func(ctx))
+			}, nil
+		}
+		op2Str = strings.Replace(op2Str, "\\*", "*", -1)
+		return func(ctx *ResponseCtx) bool {
+			return op1Func(ctx) != op2Str
+		}, nil
+	case "=":
+		if isGlob(op2Str) {
+			return func(ctx *ResponseCtx) bool {
+				return glob.Glob(op2Str, op1Func(ctx))
+			}, nil
+		}
+		op2Str = strings.Replace(op2Str, "\\*", "*", -1)
+		return func(ctx *ResponseCtx) bool {
+			return op1Func(ctx) == op2Str
+		}, nil
+	case "~", "!~", "~*", "!~*":
+		pattern := op2Str
+		if strings.HasSuffix(operator, "*") {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		negate := strings.HasPrefix(operator, "!")
+		return func(ctx *ResponseCtx) bool {
+			return re.MatchString(op1Func(ctx)) != negate
+		}, nil
+	case "*=":
+		return func(ctx *ResponseCtx) bool {
+			return strings.Contains(op1Func(ctx), op2Str)
+		}, nil
+	case "!*=":
+		return func(ctx *ResponseCtx) bool {
+			return !strings.Contains(op1Func(ctx), op2Str)
+		}, nil
+	case ">":
+		op2Num, err := parseOperand2(op1Str, op2Str)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx *ResponseCtx) bool {
+			op1Num, err := strconv.ParseFloat(op1Func(ctx), 64)
+			handleRuleErr(err)
+			return op1Num > op2Num
+		}, nil
+	case "<":
+		op2Num, err := parseOperand2(op1Str, op2Str)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx *ResponseCtx) bool {
+			op1Num, err := strconv.ParseFloat(op1Func(ctx), 64)
+			handleRuleErr(err)
+			return op1Num < op2Num
+		}, nil
+	}
+
+	return nil, errors.Errorf("invalid operator '%s'", operator)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func testResponseCtx(status int, header http.Header, body string) *ResponseCtx {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &ResponseCtx{
+		Response: &http.Response{
+			StatusCode: status,
+			Header:     header,
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		},
+		ResponseTime: 2,
+	}
+}
+
+func evalCondition(t *testing.T, condition string, ctx *ResponseCtx) bool {
+	t.Helper()
+
+	matches, err := parseCondition(condition)
+	if err != nil {
+		t.Fatalf("%s: %v", condition, err)
+	}
+	return matches(ctx)
+}
+
+type conditionTest struct {
+	condition string
+	status    int
+	body      string
+	expected  bool
+}
+
+func runConditionTests(t *testing.T, tests []conditionTest) {
+	t.Helper()
+
+	for _, test := range tests {
+		header := http.Header{}
+		header.Set("X-Test", "20")
+
+		ctx := testResponseCtx(test.status, header, test.body)
+		if evalCondition(t, test.condition, ctx) != test.expected {
+			t.Errorf("%s (status: %d, body: %q): expected %v", test.condition, test.status, test.body, test.expected)
+		}
+	}
+}
+
+// Conditions from the README before AND/OR/NOT were supported
+func TestParseConditionLegacy(t *testing.T) {
+	runConditionTests(t, []conditionTest{
+		{"header:X-Test>10", 200, "", true},
+		{"header:X-Test<10", 200, "", false},
+		{"body=*Try again in a few minutes*", 200, "Error. Try again in a few minutes.", true},
+		{"body=*Try again in a few minutes*", 200, "Try again later", false},
+		{"response_time>10s", 200, "", false},
+		{"response_time>1s", 200, "", true},
+		{"status>500", 503, "", true},
+		{"status>500", 500, "", false},
+		{"status=404", 404, "", true},
+		{"status=40*", 403, "", true},
+		{"status=40*", 500, "", false},
+		{"status=403", 403, "", true},
+	})
+}
+
+func TestParseConditionUnquotedValues(t *testing.T) {
+	runConditionTests(t, []conditionTest{
+		{"body=*a>b*", 200, "if a>b then", true},
+		{"body=*a>b*", 200, "if a<b then", false},
+		{"body=*AND status=500*", 200, "x AND status=500 x", true},
+		{"body=*Too many requests OR try again*", 200, "Too many requests OR try again", true},
+		{"(body=(x))", 200, "(x)", true},
+		{"(body=(x))", 200, "x", false},
+		{"(body=*(x y)* )", 200, "a (x y) b", true},
+		{"NOT (body=(x)) AND status=200", 200, "y", true},
+	})
+}
+
+func TestParseConditionPrecedence(t *testing.T) {
+	runConditionTests(t, []conditionTest{
+		// AND binds tighter than OR
+		{"status=404 OR status=500 AND body=*x*", 404, "", true},
+		{"status=404 OR status=500 AND body=*x*", 500, "", false},
+		{"status=404 OR status=500 AND body=*x*", 500, "x", true},
+		{"(status=404 OR status=500) AND body=*x*", 404, "", false},
+		// NOT binds tighter than AND
+		{"NOT status=404 AND body=*x*", 500, "x", true},
+		{"NOT status=404 AND body=*x*", 404, "x", false},
+		{"NOT (status=404 AND body=*x*)", 404, "", true},
+		{"NOT NOT status=404", 404, "", true},
+		{"NOT (status=404 OR body=\"Not found\")", 200, "Not found", false},
+		{"NOT (status=404 OR body=\"Not found\")", 200, "Found", true},
+	})
+}
+
+func TestParseConditionOperands(t *testing.T) {
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	ctx := testResponseCtx(200, header, `{"items": [{"some key": "x"}], "c d": "y", "a]b": "z"}`)
+
+	for _, condition := range []string{
+		"json:$.items[0]['some key']=x",
+		`json:$["c d"]=y`,
+		"json:$['a]b']=z",
+		`json:$.items[0]["some key"]=x AND json:$["c d"]=y`,
+	} {
+		if !evalCondition(t, condition, ctx) {
+			t.Errorf("%s: expected true", condition)
+		}
+	}
+}
+
+func TestParseConditionErrors(t *testing.T) {
+
+	tests := []struct {
+		condition string
+		position  string
+	}{
+		{"", "at position 1: expected condition"},
+		{"status", "at position 7: expected operator after 'status'"},
+		{"foo=1", "at position 1: invalid operand 'foo'"},
+		{"status=1 AND (", "at position 15: expected condition"},
+		{"(status=1", "at position 10: expected ')'"},
+		{"(status=1))", "at position 11: unexpected ')'"},
+		{"status>abc", "at position 8: "},
+		{"body=\"abc", "at position 6: unterminated string"},
+		{"status=1 AND body~(", "at position 19: "},
+		{"json:$.a[0=1", "at position 9: missing ']'"},
+		{"(status=1) AND json:a=1", "at position 16: invalid operand 'json:a'"},
+		{"html:\"div >\"=x", "at position 1: invalid operand 'html:div >'"},
+	}
+
+	for _, test := range tests {
+		_, err := parseCondition(test.condition)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.condition)
+			continue
+		}
+		if !strings.Contains(err.Error(), "("+test.position) {
+			t.Errorf("%s: expected '%s', got '%v'", test.condition, test.position, err)
+		}
+	}
+}
+
+func TestParseRequestCondition(t *testing.T) {
+
+	tests := []struct {
+		condition string
+		valid     bool
+	}{
+		{"url=*example.com*", true},
+		{"path=/a/* AND query:page>2", true},
+		{"NOT method=POST", true},
+		{"status=200", false},
+		{"method=GET AND body=*x*", false},
+		{"header:X-Test=1", false},
+		{"json:$.a=1", false},
+		{"html:div=x", false},
+		{"response_time>1s", false},
+	}
+
+	for _, test := range tests {
+		_, err := parseRequestCondition(test.condition)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid=%v, got %v", test.condition, test.valid, err)
+		}
+	}
+}
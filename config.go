@@ -1,18 +1,21 @@
 package main
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
+	"github.com/andybalholm/cascadia"
 	"github.com/pkg/errors"
-	"github.com/ryanuber/go-glob"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
+	"mime"
 	"os"
 	"reflect"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,13 +27,31 @@ func (a HostRuleAction) String() string {
 		return "force_retry"
 	case ShouldRetry:
 		return "should_retry"
+	case BanProxy:
+		return "ban_proxy"
+	case CooldownHost:
+		return "cooldown_host"
+	case SetWait:
+		return "set_wait"
+	case FailWithStatus:
+		return "fail_with_status"
+	case UseProxyTag:
+		return "use_proxy_tag"
 	}
 	return "???"
 }
 
 func parseRule(raw *RawHostRule) (*HostRule, error) {
 
-	rule := &HostRule{}
+	rule := &HostRule{
+		Arg:       raw.Arg,
+		Condition: raw.Condition,
+		Name:      raw.Name,
+		Priority:  raw.Priority,
+		Stop:      raw.Stop,
+	}
+
+	var err error
 
 	switch raw.Action {
 	case "should_retry":
@@ -39,78 +60,119 @@ func parseRule(raw *RawHostRule) (*HostRule, error) {
 		rule.Action = DontRetry
 	case "force_retry":
 		rule.Action = ForceRetry
+	case "ban_proxy":
+		rule.Action = BanProxy
+		// A plain number is a number of minutes
+		if minutes, err := strconv.ParseFloat(raw.Arg, 64); err == nil {
+			rule.Duration = time.Duration(minutes * float64(time.Minute))
+		} else {
+			rule.Duration, err = time.ParseDuration(raw.Arg)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid arg for ban_proxy: %s", raw.Arg)
+			}
+		}
+	case "cooldown_host":
+		rule.Action = CooldownHost
+		rule.Duration, err = time.ParseDuration(raw.Arg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid arg for cooldown_host: %s", raw.Arg)
+		}
+	case "set_wait":
+		rule.Action = SetWait
+		rule.Duration, err = time.ParseDuration(raw.Arg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid arg for set_wait: %s", raw.Arg)
+		}
+	case "fail_with_status":
+		rule.Action = FailWithStatus
+		rule.Status, err = strconv.Atoi(raw.Arg)
+		if err != nil || rule.Status < 100 || rule.Status > 999 {
+			return nil, errors.Errorf("Invalid arg for fail_with_status: %s", raw.Arg)
+		}
+	case "use_proxy_tag":
+		rule.Action = UseProxyTag
+		if raw.Arg == "" {
+			return nil, errors.Errorf("use_proxy_tag requires a tag")
+		}
 	default:
 		return nil, errors.Errorf("Invalid argument for action: %s", raw.Action)
 	}
 
-	switch {
-	case strings.Contains(raw.Condition, "!="):
-		op1Str, op2Str := split(raw.Condition, "!=")
-		op1Func := parseOperand1(op1Str)
-		if op1Func == nil {
-			return nil, errors.Errorf("Invalid rule: %s", raw.Condition)
-		}
+	matches, err := parseCondition(raw.Condition)
+	if err != nil {
+		return nil, err
+	}
+	rule.Matches = matches
 
-		if isGlob(op2Str) {
-			rule.Matches = func(ctx *ResponseCtx) bool {
-				return !glob.Glob(op2Str, op1Func(ctx))
-			}
-		} else {
-			op2Str = strings.Replace(op2Str, "\\*", "*", -1)
-			rule.Matches = func(ctx *ResponseCtx) bool {
-				return op1Func(ctx) != op2Str
-			}
-		}
-	case strings.Contains(raw.Condition, "="):
-		op1Str, op2Str := split(raw.Condition, "=")
-		op1Func := parseOperand1(op1Str)
-		if op1Func == nil {
-			return nil, errors.Errorf("Invalid rule: %s", raw.Condition)
-		}
+	return rule, nil
+}
 
-		if isGlob(op2Str) {
-			rule.Matches = func(ctx *ResponseCtx) bool {
-				return glob.Glob(op2Str, op1Func(ctx))
-			}
-		} else {
-			op2Str = strings.Replace(op2Str, "\\*", "*", -1)
-			rule.Matches = func(ctx *ResponseCtx) bool {
-				return op1Func(ctx) == op2Str
+func (a RequestRuleAction) String() string {
+	switch a {
+	case Reject:
+		return "reject"
+	case RewriteUrl:
+		return "rewrite_url"
+	case StripQuery:
+		return "strip_query"
+	case UseTag:
+		return "use_proxy_tag"
+	}
+	return "???"
+}
+
+func parseRequestRule(raw *RawRequestRule) (*RequestRule, error) {
+
+	rule := &RequestRule{
+		Arg:     raw.Arg,
+		Replace: raw.Replace,
+	}
+
+	var err error
+
+	switch raw.Action {
+	case "reject":
+		rule.Action = Reject
+		rule.Status = 403
+		if raw.Arg != "" {
+			rule.Status, err = strconv.Atoi(raw.Arg)
+			if err != nil || rule.Status < 100 || rule.Status > 999 {
+				return nil, errors.Errorf("Invalid arg for reject: %s", raw.Arg)
 			}
 		}
-	case strings.Contains(raw.Condition, ">"):
-		op1Str, op2Str := split(raw.Condition, ">")
-		op1Func := parseOperand1(op1Str)
-		if op1Func == nil {
-			return nil, errors.Errorf("Invalid rule: %s", raw.Condition)
-		}
-		op2Num, err := parseOperand2(op1Str, op2Str)
+	case "rewrite_url":
+		rule.Action = RewriteUrl
+		rule.Pattern, err = regexp.Compile(raw.Arg)
 		if err != nil {
-			return nil, err
+			return nil, errors.Wrapf(err, "Invalid arg for rewrite_url: %s", raw.Arg)
 		}
-
-		rule.Matches = func(ctx *ResponseCtx) bool {
-			op1Num, err := strconv.ParseFloat(op1Func(ctx), 64)
-			handleRuleErr(err)
-			return op1Num > op2Num
+	case "strip_query":
+		rule.Action = StripQuery
+		if raw.Arg == "" {
+			return nil, errors.Errorf("strip_query requires a list of parameters")
 		}
-	case strings.Contains(raw.Condition, "<"):
-		op1Str, op2Str := split(raw.Condition, "<")
-		op1Func := parseOperand1(op1Str)
-		if op1Func == nil {
-			return nil, errors.Errorf("Invalid rule: %s", raw.Condition)
-		}
-		op2Num, err := parseOperand2(op1Str, op2Str)
-		if err != nil {
-			return nil, err
+		rule.Keys = strings.Split(raw.Arg, ",")
+	case "use_proxy_tag":
+		rule.Action = UseTag
+		if raw.Arg == "" {
+			return nil, errors.Errorf("use_proxy_tag requires a tag")
 		}
+	default:
+		return nil, errors.Errorf("Invalid argument for action: %s", raw.Action)
+	}
 
+	if raw.Condition == "" {
 		rule.Matches = func(ctx *ResponseCtx) bool {
-			op1Num, err := strconv.ParseFloat(op1Func(ctx), 64)
-			handleRuleErr(err)
-			return op1Num < op2Num
+			return true
 		}
+		return rule, nil
+	}
+
+	matches, err := parseRequestCondition(raw.Condition)
+	if err != nil {
+		return nil, err
 	}
+	rule.Matches = matches
 
 	return rule, nil
 }
@@ -121,14 +183,6 @@ func handleRuleErr(err error) {
 	}
 }
 
-func split(str, subStr string) (string, string) {
-
-	str1 := str[:strings.Index(str, subStr)]
-	str2 := str[strings.Index(str, subStr)+len(subStr):]
-
-	return str1, str2
-}
-
 func parseOperand2(op1, op2 string) (float64, error) {
 	if op1 == "response_time" {
 		res, err := time.ParseDuration(op2)
@@ -141,37 +195,87 @@ func parseOperand2(op1, op2 string) (float64, error) {
 	return strconv.ParseFloat(op2, 64)
 }
 
-func parseOperand1(op string) func(ctx *ResponseCtx) string {
+func parseOperand1(op string) (func(ctx *ResponseCtx) string, error) {
 	switch {
 	case op == "body":
 		return func(ctx *ResponseCtx) string {
-
+			return ctx.inspectBody()
+		}, nil
+	case op == "status":
+		return func(ctx *ResponseCtx) string {
 			if ctx.Response == nil {
 				return ""
 			}
-			bodyBytes, err := ioutil.ReadAll(ctx.Response.Body)
-			if err != nil {
+			return strconv.Itoa(ctx.Response.StatusCode)
+		}, nil
+	case op == "response_time":
+		return func(ctx *ResponseCtx) string {
+			return strconv.FormatFloat(ctx.ResponseTime, 'f', 6, 64)
+		}, nil
+	case op == "content_type":
+		return func(ctx *ResponseCtx) string {
+			if ctx.Response == nil {
 				return ""
 			}
-			err = ctx.Response.Body.Close()
+			contentType := ctx.Response.Header.Get("Content-Type")
+			mediaType, _, err := mime.ParseMediaType(contentType)
 			if err != nil {
-				return ""
+				return contentType
 			}
-			ctx.Response.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
-
-			return string(bodyBytes)
-		}
-	case op == "status":
+			return mediaType
+		}, nil
+	case op == "url":
 		return func(ctx *ResponseCtx) string {
-			if ctx.Response == nil {
+			return ctx.RequestCtx.Request.URL.String()
+		}, nil
+	case op == "path":
+		return func(ctx *ResponseCtx) string {
+			return ctx.RequestCtx.Request.URL.Path
+		}, nil
+	case strings.HasPrefix(op, "query:"):
+		key := op[strings.Index(op, ":")+1:]
+		return func(ctx *ResponseCtx) string {
+			return ctx.RequestCtx.Request.URL.Query().Get(key)
+		}, nil
+	case op == "method":
+		return func(ctx *ResponseCtx) string {
+			return ctx.RequestCtx.Request.Method
+		}, nil
+	case op == "proxy":
+		return func(ctx *ResponseCtx) string {
+			if ctx.RequestCtx.p == nil {
 				return ""
 			}
-			return strconv.Itoa(ctx.Response.StatusCode)
+			return ctx.RequestCtx.p.Name
+		}, nil
+	case op == "retries":
+		return func(ctx *ResponseCtx) string {
+			return strconv.Itoa(ctx.RequestCtx.Retries)
+		}, nil
+	case op == "error":
+		return func(ctx *ResponseCtx) string {
+			return errorClass(ctx.Error)
+		}, nil
+	case strings.HasPrefix(op, "json:"):
+		steps, err := parseJsonPath(op[strings.Index(op, ":")+1:])
+		if err != nil {
+			return nil, &operandError{operand: op, err: err}
 		}
-	case op == "response_time":
 		return func(ctx *ResponseCtx) string {
-			return strconv.FormatFloat(ctx.ResponseTime, 'f', 6, 64)
+			return evalJsonPath(ctx.jsonBody(), steps)
+		}, nil
+	case strings.HasPrefix(op, "html:"):
+		selector, err := cascadia.Compile(op[strings.Index(op, ":")+1:])
+		if err != nil {
+			return nil, &operandError{operand: op, err: err}
 		}
+		return func(ctx *ResponseCtx) string {
+			return selectText(ctx.htmlBody(), selector)
+		}, nil
+	case op == "title":
+		return func(ctx *ResponseCtx) string {
+			return selectText(ctx.htmlBody(), titleSelector)
+		}, nil
 	case strings.HasPrefix(op, "header:"):
 		header := op[strings.Index(op, ":")+1:]
 		return func(ctx *ResponseCtx) string {
@@ -179,113 +283,457 @@ func parseOperand1(op string) func(ctx *ResponseCtx) string {
 				return ""
 			}
 			return ctx.Response.Header.Get(header)
-		}
+		}, nil
 	default:
-		return nil
+		return nil, &operandError{operand: op}
 	}
 }
 
+// Operands that can be used in request rules
+func isRequestOperand(op string) bool {
+	return op == "url" || op == "path" || op == "method" || strings.HasPrefix(op, "query:")
+}
+
 func isGlob(op string) bool {
 	tmpStr := strings.Replace(op, "\\*", "_", -1)
 
 	return strings.Contains(tmpStr, "*")
 }
 
-func loadConfig() error {
+// Active config, replaced as a whole on reload. It must not be modified
+// once it was stored
+var activeConfig atomic.Value
+
+const ConfigHashLength = 16
+
+func getConfig() *Config {
+	return activeConfig.Load().(*Config)
+}
+
+// Reads, parses and validates the config file into a new config
+func loadConfig() (*Config, error) {
 
-	configFile, err := os.Open("config.json")
+	configFile, err := os.Open(configPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer configFile.Close()
 
 	configBytes, err := ioutil.ReadAll(configFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = json.Unmarshal(configBytes, &config)
+	configBytes, err = decodeConfigFile(configBytes, isYamlFile(configPath))
 	if err != nil {
-		return err
+		return nil, errors.Wrap(err, configPath)
+	}
+
+	return loadConfigBytes(configBytes)
+}
+
+// Parses and validates a JSON config, as it was written in the config file
+func loadConfigBytes(rawBytes []byte) (*Config, error) {
+
+	configBytes, err := preprocessConfig(rawBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := parseConfig(configBytes)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Hash = configHash(rawBytes)
+	cfg.raw = rawBytes
+	return cfg, nil
+}
+
+// Identifies the contents of a config, to check which one is in use
+func configHash(configBytes []byte) string {
+	sum := sha256.Sum256(configBytes)
+	return hex.EncodeToString(sum[:])[:ConfigHashLength]
+}
+
+func parseConfig(configBytes []byte) (*Config, error) {
+
+	cfg := &Config{}
+	err := json.Unmarshal(configBytes, cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid JSON")
 	}
 
-	validateConfig()
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	config.Timeout, err = time.ParseDuration(config.TimeoutStr)
-	wait, err := time.ParseDuration(config.WaitStr)
-	config.Wait = int64(wait)
+	cfg.Timeout, err = time.ParseDuration(cfg.TimeoutStr)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid timeout")
+	}
+	wait, err := time.ParseDuration(cfg.WaitStr)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid wait")
+	}
+	cfg.Wait = int64(wait)
 
-	for i, conf := range config.Hosts {
+	rateGroups := make(map[string]*RateGroupConfig)
+	for _, group := range cfg.RateGroups {
+		group.Every, err = time.ParseDuration(group.EveryStr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid every (Rate group: %s)", group.Name)
+		}
+		if group.Burst == 0 {
+			return nil, errors.Errorf("Burst must be > 0 (Rate group: %s)", group.Name)
+		}
+		rateGroups[group.Name] = group
+	}
+
+	for i, conf := range cfg.Hosts {
 		if conf.EveryStr == "" {
 			// Look 'upwards' for every
-			for _, prevConf := range config.Hosts[:i] {
-				if glob.Glob(prevConf.Host, conf.Host) {
+			for _, prevConf := range cfg.Hosts[:i] {
+				if prevConf.covers(conf) {
 					conf.Every = prevConf.Every
 				}
 			}
 		} else {
 			conf.Every, err = time.ParseDuration(conf.EveryStr)
-			handleErr(err)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid every (Host: %s)", conf.Key)
+			}
 		}
 
 		if conf.Burst == 0 {
 			// Look 'upwards' for burst
-			for _, prevConf := range config.Hosts[:i] {
-				if glob.Glob(prevConf.Host, conf.Host) {
+			for _, prevConf := range cfg.Hosts[:i] {
+				if prevConf.covers(conf) {
 					conf.Burst = prevConf.Burst
 				}
 			}
 		}
 		if conf.Burst == 0 {
-			return errors.Errorf("Burst must be > 0 (Host: %s)", conf.Host)
+			return nil, errors.Errorf("Burst must be > 0 (Host: %s)", conf.Key)
+		}
+
+		conf.Timeout = cfg.Timeout
+		if conf.TimeoutStr == "" {
+			// Look 'upwards' for timeout
+			for _, prevConf := range cfg.Hosts[:i] {
+				if prevConf.covers(conf) {
+					conf.Timeout = prevConf.Timeout
+				}
+			}
+		} else {
+			conf.Timeout, err = time.ParseDuration(conf.TimeoutStr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid timeout (Host: %s)", conf.Key)
+			}
+		}
+
+		conf.Wait = time.Duration(cfg.Wait)
+		if conf.WaitStr == "" {
+			// Look 'upwards' for wait
+			for _, prevConf := range cfg.Hosts[:i] {
+				if prevConf.covers(conf) {
+					conf.Wait = prevConf.Wait
+				}
+			}
+		} else {
+			conf.Wait, err = time.ParseDuration(conf.WaitStr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid wait (Host: %s)", conf.Key)
+			}
+		}
+
+		if conf.Multiplier == 0 {
+			// Look 'upwards' for multiplier
+			conf.Multiplier = cfg.Multiplier
+			for _, prevConf := range cfg.Hosts[:i] {
+				if prevConf.covers(conf) {
+					conf.Multiplier = prevConf.Multiplier
+				}
+			}
+		}
+
+		if conf.RawRetries == nil {
+			// Look 'upwards' for retries
+			conf.Retries = cfg.Retries
+			for _, prevConf := range cfg.Hosts[:i] {
+				if prevConf.covers(conf) {
+					conf.Retries = prevConf.Retries
+				}
+			}
+		} else {
+			conf.Retries = *conf.RawRetries
+		}
+		if conf.Retries < 0 {
+			return nil, errors.Errorf("retries must be >= 0 (Host: %s)", conf.Key)
+		}
+
+		if conf.MaxWaitStr == "" {
+			// Look 'upwards' for max_wait
+			for _, prevConf := range cfg.Hosts[:i] {
+				if prevConf.covers(conf) {
+					conf.MaxWait = prevConf.MaxWait
+				}
+			}
+		} else {
+			conf.MaxWait, err = time.ParseDuration(conf.MaxWaitStr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid max_wait (Host: %s)", conf.Key)
+			}
+		}
+
+		if conf.Jitter == "" {
+			// Look 'upwards' for jitter
+			for _, prevConf := range cfg.Hosts[:i] {
+				if prevConf.covers(conf) {
+					conf.Jitter = prevConf.Jitter
+				}
+			}
+		}
+		if conf.Jitter != "" && conf.Jitter != JitterNone && conf.Jitter != JitterFull && conf.Jitter != JitterDecorrelated {
+			return nil, errors.Errorf("Invalid value for jitter: %s (Host: %s)", conf.Jitter, conf.Key)
+		}
+
+		// Look 'upwards' for the retry policies of each error class
+		rawPolicies := make(map[string]*RawRetryPolicy)
+		for _, prevConf := range cfg.Hosts[:i] {
+			if prevConf.covers(conf) {
+				for class, raw := range prevConf.RawRetryPolicies {
+					rawPolicies[class] = raw
+				}
+			}
+		}
+		for class, raw := range conf.RawRetryPolicies {
+			rawPolicies[class] = raw
+		}
+		conf.RawRetryPolicies = rawPolicies
+
+		conf.RetryPolicies, err = parseRetryPolicies(conf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Host: %s", conf.Key)
 		}
 
-		for _, rawRule := range conf.RawRules {
+		if conf.RobotsTxt == "" {
+			// Look 'upwards' for robots_txt & robots_user_agent
+			for _, prevConf := range cfg.Hosts[:i] {
+				if prevConf.covers(conf) {
+					conf.RobotsTxt = prevConf.RobotsTxt
+					if conf.RobotsUserAgent == "" {
+						conf.RobotsUserAgent = prevConf.RobotsUserAgent
+					}
+				}
+			}
+		}
+		if conf.RobotsTxt != "" && conf.RobotsTxt != RobotsObey && conf.RobotsTxt != RobotsIgnore {
+			return nil, errors.Errorf("Invalid value for robots_txt: %s (Host: %s)", conf.RobotsTxt, conf.Key)
+		}
+
+		if conf.RateGroup == "" && conf.GroupByIp == 0 {
+			// Look 'upwards' for rate_group & group_by_ip
+			for _, prevConf := range cfg.Hosts[:i] {
+				if prevConf.covers(conf) {
+					conf.RateGroup = prevConf.RateGroup
+					conf.GroupByIp = prevConf.GroupByIp
+				}
+			}
+		}
+		conf.rateGroup = nil
+		if conf.RateGroup != "" {
+			group, ok := rateGroups[conf.RateGroup]
+			if !ok {
+				return nil, errors.Errorf("Unknown rate group: %s (Host: %s)", conf.RateGroup, conf.Key)
+			}
+			conf.rateGroup = group
+		}
+		if conf.GroupByIp < 0 || conf.GroupByIp > 32 {
+			return nil, errors.Errorf("group_by_ip must be between 0 and 32 (Host: %s)", conf.Key)
+		}
+
+		if conf.BodyInspectSize == 0 {
+			// Look 'upwards' for body_inspect_size
+			for _, prevConf := range cfg.Hosts[:i] {
+				if prevConf.covers(conf) {
+					conf.BodyInspectSize = prevConf.BodyInspectSize
+				}
+			}
+		}
+		if conf.BodyInspectTypes == nil {
+			// Look 'upwards' for body_inspect_types
+			for _, prevConf := range cfg.Hosts[:i] {
+				if prevConf.covers(conf) {
+					conf.BodyInspectTypes = prevConf.BodyInspectTypes
+				}
+			}
+		}
+
+		if conf.MaxBytesPerSec == 0 {
+			// Look 'upwards' for max_bytes_per_sec
+			for _, prevConf := range cfg.Hosts[:i] {
+				if prevConf.covers(conf) {
+					conf.MaxBytesPerSec = prevConf.MaxBytesPerSec
+				}
+			}
+		}
+
+		for idx, rawRule := range conf.RawRules {
 			r, err := parseRule(rawRule)
-			handleErr(err)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Host: %s", conf.Key)
+			}
+			r.Host = conf.Key
+			r.Index = idx
 			conf.Rules = append(conf.Rules, r)
 
 			logrus.WithFields(logrus.Fields{
 				"arg":       r.Arg,
 				"action":    r.Action,
+				"priority":  r.Priority,
+				"stop":      r.Stop,
 				"matchFunc": runtime.FuncForPC(reflect.ValueOf(r.Matches).Pointer()).Name(),
 			}).Info("Rule")
 		}
 
+		for _, rawRule := range conf.RawRequestRules {
+			r, err := parseRequestRule(rawRule)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Host: %s", conf.Key)
+			}
+			conf.RequestRules = append(conf.RequestRules, r)
+
+			logrus.WithFields(logrus.Fields{
+				"arg":    r.Arg,
+				"action": r.Action,
+			}).Info("Request rule")
+		}
+
+		for _, rawEntry := range conf.RawSchedule {
+			entry, err := parseScheduleEntry(rawEntry)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid schedule (Host: %s)", conf.Key)
+			}
+			conf.Schedule = append(conf.Schedule, entry)
+		}
+
 		logrus.WithFields(logrus.Fields{
-			"every":   conf.Every,
-			"burst":   conf.Burst,
-			"headers": conf.Headers,
-			"host":    conf.Host,
+			"every":    conf.Every,
+			"burst":    conf.Burst,
+			"timeout":  conf.Timeout,
+			"wait":     conf.Wait,
+			"retries":  conf.Retries,
+			"max_bps":  conf.MaxBytesPerSec,
+			"robots":   conf.RobotsTxt,
+			"schedule": len(conf.Schedule),
+			"group":    conf.RateGroup,
+			"headers":  conf.Headers,
+			"host":     conf.Key,
 		}).Info("Host")
 	}
 
-	return nil
+	return cfg, nil
 }
 
-func validateConfig() {
+func validateConfig(cfg *Config) error {
+
+	for _, conf := range cfg.Hosts {
 
-	for _, conf := range config.Hosts {
+		conf.Method = strings.ToUpper(conf.Method)
+		conf.Scheme = strings.ToLower(conf.Scheme)
+		conf.Key = conf.key()
 
-		if conf.Host == "*" {
-			config.DefaultConfig = conf
+		if conf.Key == "*" {
+			cfg.DefaultConfig = conf
 		}
 
 		for k := range conf.Headers {
 			if strings.ToLower(k) == "accept-encoding" {
-				panic(fmt.Sprintf("headers config for '%s':"+
-					" Do not set the Accept-Encoding header, it breaks goproxy", conf.Host))
+				return errors.Errorf("headers config for '%s':"+
+					" Do not set the Accept-Encoding header, it breaks goproxy", conf.Key)
 			}
 		}
 	}
 
-	if config.DefaultConfig == nil {
-		panic("config.json: You must specify a default host ('*')")
+	if cfg.DefaultConfig == nil {
+		return errors.New("You must specify a default host ('*')")
+	}
+	return nil
+}
+
+// Loads the config and swaps it in. The current config is kept if the new one is invalid
+func (a *Architeuthis) reloadConfig() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		logrus.WithError(err).Error("Could not load config, keeping the current config")
+		return err
 	}
+	a.setLocalConfig(cfg)
+	return a.activateConfig(cfg, "reload")
 }
 
-func (a *Architeuthis) reloadConfig() {
-	_ = loadConfig()
-	logrus.Info("Reloaded config")
+// Keeps the config loaded from the config file, returns false if the file
+// didn't change since it was last loaded
+func (a *Architeuthis) setLocalConfig(cfg *Config) bool {
+
+	a.configMu.Lock()
+	defer a.configMu.Unlock()
+
+	changed := a.localConfig == nil || a.localConfig.Hash != cfg.Hash
+	a.localConfig = cfg
+	return changed
+}
+
+// The config file was written by this instance, with the contents of the active config
+func (a *Architeuthis) setLocalConfigHash(hash string) {
+
+	a.configMu.Lock()
+	defer a.configMu.Unlock()
+
+	if a.localConfig != nil {
+		local := *a.localConfig
+		local.Hash = hash
+		a.localConfig = &local
+	}
+}
+
+func (a *Architeuthis) swapConfig(cfg *Config) {
+
+	a.configMu.Lock()
+	defer a.configMu.Unlock()
+
+	var previousHash string
+	if previous, ok := activeConfig.Load().(*Config); ok {
+		if cfg.Version != 0 && cfg.Version <= previous.Version {
+			// Already active, or an older version of the cluster config that arrived late
+			return
+		}
+		previousHash = previous.Hash
+	}
+
+	if a.clusterConfig && a.localConfig != nil {
+		// The cluster shares the config, except the settings of this instance
+		cfg.Addr = a.localConfig.Addr
+		cfg.RedisUrl = a.localConfig.RedisUrl
+		cfg.InfluxUrl = a.localConfig.InfluxUrl
+		cfg.InfluxUser = a.localConfig.InfluxUser
+		cfg.InfluxPass = a.localConfig.InfluxPass
+	}
+
+	cfg.LoadedAt = time.Now()
+	activeConfig.Store(cfg)
+
+	logrus.WithFields(logrus.Fields{
+		"hash":     cfg.Hash,
+		"version":  cfg.Version,
+		"previous": previousHash,
+	}).Info("Reloaded config")
+
+	if a.redis != nil {
+		// Proxies might have been added to the config
+		a.addConfigProxies(cfg)
+	}
 }
 
 func handleErr(err error) {
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigInheritance(t *testing.T) {
+
+	cfg := useTestConfig(t, `{
+		"timeout": "15s", "wait": "4s", "multiplier": 2.5, "retries": 3,
+		"hosts": [
+			{"host": "*", "every": "500ms", "burst": 25},
+			{"host": "*.example.com", "every": "1s", "timeout": "5s", "retries": 1, "max_wait": "30s", "jitter": "full"},
+			{"host": "*.api.example.com", "wait": "1s", "burst": 5},
+			{"host": "*.example.com", "path": "/slow/*", "timeout": "60s", "retries": 0, "multiplier": 1},
+			{"host": "*.other.com", "wait": "2s"}
+		]
+	}`)
+
+	tests := []struct {
+		key        string
+		every      time.Duration
+		burst      int
+		timeout    time.Duration
+		wait       time.Duration
+		multiplier float64
+		retries    int
+		maxWait    time.Duration
+		jitter     string
+	}{
+		{"*", 500 * time.Millisecond, 25, 15 * time.Second, 4 * time.Second, 2.5, 3, 0, ""},
+		{"*.example.com", time.Second, 25, 5 * time.Second, 4 * time.Second, 2.5, 1, 30 * time.Second, "full"},
+		{"*.api.example.com", time.Second, 5, 5 * time.Second, time.Second, 2.5, 1, 30 * time.Second, "full"},
+		// retries: 0 is not inherited
+		{"*.example.com;path=/slow/*", time.Second, 25, 60 * time.Second, 4 * time.Second, 1, 0, 30 * time.Second, "full"},
+		{"*.other.com", 500 * time.Millisecond, 25, 15 * time.Second, 2 * time.Second, 2.5, 3, 0, ""},
+	}
+
+	if len(cfg.Hosts) != len(tests) {
+		t.Fatalf("expected %d host configs, got %d", len(tests), len(cfg.Hosts))
+	}
+
+	for i, test := range tests {
+		conf := cfg.Hosts[i]
+		if conf.Key != test.key {
+			t.Errorf("expected %s, got %s", test.key, conf.Key)
+			continue
+		}
+		if conf.Every != test.every || conf.Burst != test.burst || conf.Timeout != test.timeout ||
+			conf.Wait != test.wait || conf.Multiplier != test.multiplier || conf.Retries != test.retries ||
+			conf.MaxWait != test.maxWait || conf.Jitter != test.jitter {
+			t.Errorf("%s: unexpected config every=%s burst=%d timeout=%s wait=%s multiplier=%v retries=%d max_wait=%s jitter=%s",
+				conf.Key, conf.Every, conf.Burst, conf.Timeout, conf.Wait, conf.Multiplier, conf.Retries, conf.MaxWait, conf.Jitter)
+		}
+	}
+}
+
+func TestConfigRetryPolicyInheritance(t *testing.T) {
+
+	cfg := useTestConfig(t, `{
+		"timeout": "15s", "wait": "4s", "multiplier": 2, "retries": 3,
+		"hosts": [
+			{"host": "*", "every": "1s", "burst": 1, "retry_policies": {"429": {"retries": 10, "wait": "30s"}}},
+			{"host": "*.example.com", "retries": 1, "retry_policies": {"5xx": {"multiplier": 3}}}
+		]
+	}`)
+
+	conf := cfg.Hosts[1]
+	tests := []struct {
+		class      string
+		retries    int
+		wait       time.Duration
+		multiplier float64
+	}{
+		{Retry429, 10, 30 * time.Second, 2},
+		// Unset fields are the ones of the host
+		{Retry5xx, 1, 4 * time.Second, 3},
+		{RetryNetwork, 1, 4 * time.Second, 2},
+		{"", 1, 4 * time.Second, 2},
+	}
+
+	for _, test := range tests {
+		policy := conf.retryPolicy(test.class)
+		if policy.Retries != test.retries || policy.Wait != test.wait || policy.Multiplier != test.multiplier {
+			t.Errorf("%s: unexpected policy %+v", retryClassName(test.class), *policy)
+		}
+	}
+}
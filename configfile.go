@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const DefaultConfigPath = "config.json"
+
+// Top-level config fields can be overridden with ARCHITEUTHIS_<FIELD>, e.g. ARCHITEUTHIS_REDIS_URL
+const EnvPrefix = "ARCHITEUTHIS_"
+
+// Set with the -config flag
+var configPath = DefaultConfigPath
+
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+func isYamlFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yml" || ext == ".yaml"
+}
+
+// Decodes a JSON or YAML config file. Returns the config as JSON, as it was
+// written (without interpolation and environment overrides)
+func decodeConfigFile(configBytes []byte, isYaml bool) ([]byte, error) {
+
+	var tree interface{}
+	if isYaml {
+		err := yaml.Unmarshal(configBytes, &tree)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid YAML")
+		}
+		tree = yamlToJson(tree)
+	} else {
+		err := json.Unmarshal(configBytes, &tree)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid JSON")
+		}
+	}
+
+	if _, ok := tree.(map[string]interface{}); !ok {
+		return nil, errors.New("Config must be an object")
+	}
+
+	return json.Marshal(tree)
+}
+
+// Interpolates ${ENV} variables and applies the environment overrides of a JSON config
+func preprocessConfig(configBytes []byte) ([]byte, error) {
+
+	var root map[string]interface{}
+	err := json.Unmarshal(configBytes, &root)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid JSON")
+	}
+	if root == nil {
+		return nil, errors.New("Config must be an object")
+	}
+
+	_, err = interpolateEnv(root)
+	if err != nil {
+		return nil, err
+	}
+
+	err = applyEnvOverrides(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(root)
+}
+
+// yaml.v2 decodes objects as map[interface{}]interface{}, which can't be encoded to JSON
+func yamlToJson(value interface{}) interface{} {
+
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[toString(key)] = yamlToJson(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = yamlToJson(item)
+		}
+	}
+	return value
+}
+
+func toString(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return str
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+// Replaces ${NAME} with the value of the environment variable NAME in all string values
+func interpolateEnv(value interface{}) (interface{}, error) {
+
+	switch v := value.(type) {
+	case string:
+		var err error
+		result := envVarPattern.ReplaceAllStringFunc(v, func(match string) string {
+			name := envVarPattern.FindStringSubmatch(match)[1]
+			envValue, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = errors.Errorf("Environment variable %s is not set", name)
+			}
+			return envValue
+		})
+		return result, err
+	case map[string]interface{}:
+		for key, item := range v {
+			newItem, err := interpolateEnv(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = newItem
+		}
+	case []interface{}:
+		for i, item := range v {
+			newItem, err := interpolateEnv(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = newItem
+		}
+	}
+	return value, nil
+}
+
+// Overrides the top-level fields of the config (strings, numbers and booleans)
+// with the ARCHITEUTHIS_<FIELD> environment variables
+func applyEnvOverrides(root map[string]interface{}) error {
+
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		envName := EnvPrefix + strings.ToUpper(name)
+		envValue, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+
+		var err error
+		switch field.Type.Kind() {
+		case reflect.String:
+			root[name] = envValue
+		case reflect.Int, reflect.Int64:
+			root[name], err = strconv.ParseInt(envValue, 10, 64)
+		case reflect.Float64:
+			root[name], err = strconv.ParseFloat(envValue, 64)
+		case reflect.Bool:
+			root[name], err = strconv.ParseBool(envValue)
+		default:
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Invalid value for %s", envName)
+		}
+	}
+	return nil
+}
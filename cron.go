@@ -22,7 +22,7 @@ func (a *Architeuthis) setupProxyReviver() {
 	}).Info("Started proxy revive cron")
 }
 
-func (a *Architeuthis) testUrl(ch chan *Proxy, url string, wg sync.WaitGroup) {
+func (a *Architeuthis) testUrl(ch chan *Proxy, url string, wg *sync.WaitGroup) {
 
 	for p := range ch {
 		r, _ := p.HttpClient.Get(url)
@@ -43,12 +43,13 @@ func (a *Architeuthis) reviveProxies() {
 	ch := make(chan *Proxy, checkers)
 
 	for i := 0; i < checkers; i++ {
-		go a.testUrl(ch, "https://google.com/", wg)
+		go a.testUrl(ch, "https://google.com/", &wg)
 	}
 
 	for _, p := range a.GetDeadProxies() {
 		ch <- p
 	}
+	close(ch)
 
 	wg.Wait()
 }
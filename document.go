@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/andybalholm/cascadia"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+	"strconv"
+	"strings"
+)
+
+var titleSelector = cascadia.MustCompile("title")
+
+// One step of a JSON path: either an object key or an array index
+type jsonPathStep struct {
+	key   string
+	index int
+}
+
+// Parses a (small) subset of JSONPath: $.a.b[0]["c d"]
+func parseJsonPath(path string) ([]jsonPathStep, error) {
+
+	if !strings.HasPrefix(path, "$") {
+		return nil, errors.Errorf("JSON path must start with '$': %s", path)
+	}
+
+	var steps []jsonPathStep
+	i := 1
+	for i < len(path) {
+		switch path[i] {
+		case '.':
+			end := i + 1
+			for end < len(path) && path[end] != '.' && path[end] != '[' {
+				end++
+			}
+			if end == i+1 {
+				return nil, errors.Errorf("Empty key in JSON path: %s", path)
+			}
+			steps = append(steps, jsonPathStep{key: path[i+1 : end], index: -1})
+			i = end
+		case '[':
+			// Quoted keys can contain ']'
+			from := i
+			if i+1 < len(path) && (path[i+1] == '"' || path[i+1] == '\'') {
+				if q := strings.IndexByte(path[i+2:], path[i+1]); q >= 0 {
+					from = i + 2 + q
+				}
+			}
+			end := strings.IndexByte(path[from:], ']')
+			if end < 0 {
+				return nil, errors.Errorf("Missing ']' in JSON path: %s", path)
+			}
+			end += from - i
+			inner := path[i+1 : i+end]
+			if len(inner) >= 2 && (inner[0] == '"' || inner[0] == '\'') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, jsonPathStep{key: inner[1 : len(inner)-1], index: -1})
+			} else {
+				index, err := strconv.Atoi(inner)
+				if err != nil || index < 0 {
+					return nil, errors.Errorf("Invalid index in JSON path: %s", path)
+				}
+				steps = append(steps, jsonPathStep{index: index})
+			}
+			i += end + 1
+		default:
+			return nil, errors.Errorf("Invalid JSON path: %s", path)
+		}
+	}
+
+	return steps, nil
+}
+
+// Returns the string value at this path, or "" if it doesn't exist
+func evalJsonPath(doc interface{}, steps []jsonPathStep) string {
+
+	value := doc
+	for _, step := range steps {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if step.index >= 0 {
+				return ""
+			}
+			value = v[step.key]
+		case []interface{}:
+			if step.index < 0 || step.index >= len(v) {
+				return ""
+			}
+			value = v[step.index]
+		default:
+			return ""
+		}
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+// Parsed JSON body, nil if the (inspected part of the) body isn't valid JSON
+func (ctx *ResponseCtx) jsonBody() interface{} {
+
+	if !ctx.jsonParsed {
+		ctx.jsonParsed = true
+
+		decoder := json.NewDecoder(strings.NewReader(ctx.inspectBody()))
+		decoder.UseNumber()
+		if err := decoder.Decode(&ctx.json); err != nil {
+			ctx.json = nil
+		}
+	}
+	return ctx.json
+}
+
+// Parsed HTML body
+func (ctx *ResponseCtx) htmlBody() *html.Node {
+
+	if !ctx.htmlParsed {
+		ctx.htmlParsed = true
+
+		doc, err := html.Parse(strings.NewReader(ctx.inspectBody()))
+		if err == nil {
+			ctx.html = doc
+		}
+	}
+	return ctx.html
+}
+
+// Text content of the first node matching the selector
+func selectText(doc *html.Node, selector cascadia.Selector) string {
+
+	if doc == nil {
+		return ""
+	}
+
+	node := selector.MatchFirst(doc)
+	if node == nil {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			buf.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(node)
+
+	return strings.TrimSpace(buf.String())
+}
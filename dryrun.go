@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Sample request/response for dry-running the rules
+type RuleTestInput struct {
+	Host         string            `json:"host"`
+	Url          string            `json:"url"`
+	Method       string            `json:"method"`
+	Proxy        string            `json:"proxy"`
+	Retries      int               `json:"retries"`
+	Status       int               `json:"status"`
+	Headers      map[string]string `json:"headers"`
+	Body         string            `json:"body"`
+	ResponseTime string            `json:"response_time"`
+}
+
+type RuleTestMatch struct {
+	Host      string `json:"host"`
+	Index     int    `json:"index"`
+	Condition string `json:"condition"`
+	Action    string `json:"action"`
+	Arg       string `json:"arg,omitempty"`
+	Priority  int    `json:"priority"`
+	Stop      bool   `json:"stop,omitempty"`
+}
+
+type RuleTestOutput struct {
+	Url         string          `json:"url"`
+	Rejected    bool            `json:"rejected,omitempty"`
+	Configs     []string        `json:"configs"`
+	Matched     []RuleTestMatch `json:"matched"`
+	Rule        *RuleTestMatch  `json:"rule,omitempty"`
+	Success     bool            `json:"success"`
+	ShouldRetry bool            `json:"should_retry"`
+	Error       string          `json:"error,omitempty"`
+	Status      int             `json:"status"`
+	Wait        string          `json:"wait,omitempty"`
+	BanProxy    string          `json:"ban_proxy,omitempty"`
+	Cooldown    string          `json:"cooldown_host,omitempty"`
+	ProxyTag    string          `json:"proxy_tag,omitempty"`
+}
+
+// Evaluates the request rules and the rules of the current config against a
+// sample response, the same way processRequest does, without sending anything
+func testRules(input RuleTestInput) (*RuleTestOutput, error) {
+
+	rawUrl := input.Url
+	if rawUrl == "" {
+		if input.Host == "" {
+			return nil, errors.New("host or url is required")
+		}
+		rawUrl = "http://" + input.Host + "/"
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	method := input.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	var responseTime time.Duration
+	if input.ResponseTime != "" {
+		responseTime, err = time.ParseDuration(input.ResponseTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	status := input.Status
+	if status == 0 {
+		status = 200
+	}
+
+	header := http.Header{}
+	for k, v := range input.Headers {
+		header.Set(k, v)
+	}
+
+	rCtx := &RequestCtx{
+		Request: &http.Request{
+			Method: method,
+			URL:    u,
+			Host:   u.Host,
+			Header: http.Header{},
+		},
+		Retries: input.Retries,
+	}
+	rCtx.configs = getConfigsMatchingRequest(rCtx.Request)
+	if input.Proxy != "" {
+		rCtx.p = &Proxy{Name: input.Proxy}
+	}
+
+	output := &RuleTestOutput{
+		Configs: []string{},
+		Matched: []RuleTestMatch{},
+		Status:  status,
+	}
+
+	rejectStatus, err := applyRequestRules(rCtx)
+	if err != nil {
+		return nil, err
+	}
+	output.Url = rCtx.Request.URL.String()
+	output.ProxyTag = rCtx.proxyTag
+	for _, conf := range rCtx.configs {
+		output.Configs = append(output.Configs, conf.Key)
+	}
+	if rejectStatus != 0 {
+		output.Rejected = true
+		output.Status = rejectStatus
+		output.Error = "Rejected by request rule"
+		return output, nil
+	}
+
+	responseCtx := ResponseCtx{
+		RequestCtx: rCtx,
+		Response: &http.Response{
+			StatusCode: status,
+			Header:     header,
+			Body:       ioutil.NopCloser(strings.NewReader(input.Body)),
+			Request:    rCtx.Request,
+		},
+		ResponseTime: responseTime.Seconds(),
+	}
+
+	result := computeRules(rCtx, &responseCtx)
+	decideRetry(rCtx, &responseCtx, result)
+
+	var wait time.Duration
+	if responseCtx.ShouldRetry {
+		// The input retries are counted against the policy of this response's class
+		class := retryClass(&responseCtx, false)
+		rCtx.classRetries = map[string]int{class: input.Retries}
+		wait = countRetry(rCtx, &responseCtx, class, result.Wait)
+	}
+
+	for _, rule := range result.Matched {
+		match := RuleTestMatch{
+			Host:      rule.Host,
+			Index:     rule.Index,
+			Condition: rule.Condition,
+			Action:    rule.Action.String(),
+			Arg:       rule.Arg,
+			Priority:  rule.Priority,
+			Stop:      rule.Stop,
+		}
+		output.Matched = append(output.Matched, match)
+		if rule == result.Rule {
+			output.Rule = &match
+		}
+	}
+
+	// Same as processRequestWithCtx, a response is only good if no rule made it fail
+	output.Success = isHttpSuccessCode(status) && responseCtx.Error == nil
+	output.ShouldRetry = responseCtx.ShouldRetry
+	output.Status = responseCtx.Response.StatusCode
+	if responseCtx.Error != nil {
+		output.Error = responseCtx.Error.Error()
+	}
+	if responseCtx.ShouldRetry && wait > 0 {
+		output.Wait = wait.String()
+	}
+	if result.BanProxy > 0 {
+		output.BanProxy = result.BanProxy.String()
+	}
+	if result.CooldownHost > 0 {
+		output.Cooldown = result.CooldownHost.String()
+	}
+	if result.ProxyTag != "" {
+		output.ProxyTag = result.ProxyTag
+	}
+
+	return output, nil
+}
+
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	col := strings.Index(value, ":")
+	if col < 0 {
+		return errors.Errorf("Invalid header: %s (expected 'Name: value')", value)
+	}
+	h[strings.TrimSpace(value[:col])] = strings.TrimSpace(value[col+1:])
+	return nil
+}
+
+// architeuthis test-rules -host example.com -status 403 -body '...'
+func runTestRulesCommand(args []string) error {
+
+	input := RuleTestInput{Headers: headerFlags{}}
+
+	flags := flag.NewFlagSet("test-rules", flag.ContinueOnError)
+	flags.StringVar(&input.Host, "host", "", "Host of the request")
+	flags.StringVar(&input.Url, "url", "", "URL of the request (overrides -host)")
+	flags.StringVar(&input.Method, "method", "GET", "HTTP method of the request")
+	flags.StringVar(&input.Proxy, "proxy", "", "Name of the proxy")
+	flags.IntVar(&input.Retries, "retries", 0, "Number of retries so far (of the response's error class)")
+	flags.IntVar(&input.Status, "status", 200, "HTTP status of the response")
+	flags.Var(headerFlags(input.Headers), "header", "Response header ('Name: value'), can be repeated")
+	flags.StringVar(&input.Body, "body", "", "Body of the response")
+	bodyFile := flags.String("body-file", "", "Read the body of the response from this file")
+	flags.StringVar(&input.ResponseTime, "response-time", "", "Response time (e.g. 2s)")
+	flags.StringVar(&configPath, "config", DefaultConfigPath, "Path of the config file (JSON or YAML)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *bodyFile != "" {
+		body, err := ioutil.ReadFile(*bodyFile)
+		if err != nil {
+			return err
+		}
+		input.Body = string(body)
+	}
+
+	logrus.SetLevel(logrus.WarnLevel)
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	activeConfig.Store(cfg)
+
+	output, err := testRules(input)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(output)
+}
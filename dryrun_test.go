@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestTestRules(t *testing.T) {
+
+	useTestConfig(t, `{
+		"timeout": "1s", "wait": "1s", "multiplier": 2, "retries": 3,
+		"hosts": [{
+			"host": "*", "every": "1s", "burst": 1,
+			"request_rules": [
+				{"condition": "path=/logout*", "action": "reject", "arg": "400"},
+				{"action": "rewrite_url", "arg": "^http://a\\.com", "replace": "http://b.com"}
+			]
+		}, {
+			"host": ".b.com", "every": "1s", "burst": 1, "retries": 2
+		}]
+	}`)
+
+	tests := []struct {
+		input       RuleTestInput
+		url         string
+		rejected    bool
+		status      int
+		shouldRetry bool
+		err         string
+	}{
+		{RuleTestInput{Url: "http://a.com/logout"}, "http://a.com/logout", true, 400, false, "Rejected by request rule"},
+		{RuleTestInput{Url: "http://a.com/x"}, "http://b.com/x", false, 200, false, ""},
+		{RuleTestInput{Url: "http://a.com/x", Status: 503, Retries: 1}, "http://b.com/x", false, 503, true, "HTTP error: 503"},
+		// The retries of the rewritten host apply
+		{RuleTestInput{Url: "http://a.com/x", Status: 503, Retries: 2}, "http://b.com/x", false, 503, false, "Giving up after 2 retries (5xx)"},
+		{RuleTestInput{Url: "http://c.com/x", Status: 503, Retries: 2}, "http://c.com/x", false, 503, true, "HTTP error: 503"},
+	}
+
+	for _, test := range tests {
+		output, err := testRules(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output.Url != test.url || output.Rejected != test.rejected || output.Status != test.status ||
+			output.ShouldRetry != test.shouldRetry || output.Error != test.err {
+			t.Errorf("%+v: unexpected output %+v", test.input, output)
+		}
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/time/rate"
 	"log"
-	"math"
 	"net"
 	"net/url"
 	"os"
@@ -40,6 +39,35 @@ func isProxyError(err error) bool {
 	return false
 }
 
+// Short name for the type of error, used by the 'error' rule operand
+func errorClass(err error) string {
+
+	if err == nil {
+		return ""
+	}
+
+	if isProxyError(err) {
+		return "proxy"
+	}
+
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return "timeout"
+	}
+
+	if opErr, ok := err.(*net.OpError); ok {
+		if _, ok := opErr.Err.(*net.DNSError); ok {
+			return "dns"
+		}
+		return "network"
+	}
+
+	return "other"
+}
+
 func isPermanentError(err error) bool {
 
 	var opErr *net.OpError
@@ -101,10 +129,6 @@ func isPermanentError(err error) bool {
 	return false
 }
 
-func getWaitTime(retries int) time.Duration {
-	return time.Duration(config.Wait * int64(math.Pow(config.Multiplier, float64(retries))))
-}
-
 func (p *Proxy) waitRateLimit(limiter *rate.Limiter) {
 
 	reservation := limiter.Reserve()
@@ -3,7 +3,9 @@ module github.com/simon987/Architeuthis
 go 1.13
 
 require (
+	github.com/andybalholm/cascadia v1.1.0
 	github.com/elazarl/goproxy v0.0.0-20191011121108-aa519ddbe484
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/go-redis/redis/v7 v7.0.0-beta.5
 	github.com/go-redis/redis_rate/v8 v8.0.0
 	github.com/influxdata/influxdb1-client v0.0.0-20191209144304-8bf82d3c094d
@@ -12,6 +14,8 @@ require (
 	github.com/robfig/cron v1.2.0
 	github.com/ryanuber/go-glob v1.0.0
 	github.com/sirupsen/logrus v1.4.2
+	golang.org/x/net v0.0.0-20190923162816-aa69164e4478
 	golang.org/x/sys v0.0.0-20200103143344-a1369afcdac7 // indirect
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	gopkg.in/yaml.v2 v2.2.4
 )
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const IpGroupCacheTime = 5 * time.Minute
+
+// IPv6 addresses are always grouped by /64 network
+const IpGroupV6PrefixLen = 64
+
+type ipGroupEntry struct {
+	network string
+	expires time.Time
+}
+
+type ipGroupCache struct {
+	mu      sync.Mutex
+	entries map[string]ipGroupEntry
+}
+
+// Returns the part of the limiter key that identifies the host (or group of hosts)
+func (a *Architeuthis) getLimiterHostKey(rCtx *RequestCtx, hostConfig *HostConfig) string {
+
+	if hostConfig.rateGroup != nil {
+		return "group:" + hostConfig.rateGroup.Name
+	}
+
+	if hostConfig.GroupByIp > 0 {
+		network := a.resolveIpGroup(rCtx.ctx, rCtx.Request.URL.Hostname(), hostConfig.GroupByIp)
+		if network != "" {
+			return "net:" + network
+		}
+	}
+
+	return hostConfig.Key
+}
+
+// Returns the network (in CIDR notation) that this host name resolves to
+func (a *Architeuthis) resolveIpGroup(ctx context.Context, host string, prefixLen int) string {
+
+	cacheKey := host + "/" + strconv.Itoa(prefixLen)
+
+	a.ipGroups.mu.Lock()
+	entry, ok := a.ipGroups.entries[cacheKey]
+	a.ipGroups.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.network
+	}
+
+	var network string
+	ip := net.ParseIP(host)
+	if ip == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil || len(addrs) == 0 {
+			logrus.WithError(err).WithField("host", host).Warn("Could not resolve host for rate limit grouping")
+			return ""
+		}
+		ip = addrs[0].IP
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		network = (&net.IPNet{IP: ip4.Mask(net.CIDRMask(prefixLen, 32)), Mask: net.CIDRMask(prefixLen, 32)}).String()
+	} else {
+		mask := net.CIDRMask(IpGroupV6PrefixLen, 128)
+		network = (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+	}
+
+	a.ipGroups.mu.Lock()
+	a.ipGroups.entries[cacheKey] = ipGroupEntry{
+		network: network,
+		expires: time.Now().Add(IpGroupCacheTime),
+	}
+	a.ipGroups.mu.Unlock()
+
+	return network
+}
@@ -79,9 +79,12 @@ func (a *Architeuthis) writeMetricRequest(ctx ResponseCtx) {
 	}
 
 	var ok string
-	if ctx.Error == nil {
+	switch {
+	case ctx.Canceled:
+		ok = "canceled"
+	case ctx.Error == nil:
 		ok = "true"
-	} else {
+	default:
 		ok = "false"
 	}
 
@@ -96,7 +99,10 @@ func (a *Architeuthis) writeMetricRequest(ctx ResponseCtx) {
 	a.points <- point
 }
 
-func (a *Architeuthis) writeMetricSleep(duration time.Duration, tag string) {
+func (a *Architeuthis) writeMetricSleep(duration time.Duration, tag string, limiterKey string) {
+
+	a.addSleep(limiterKey, duration, tag)
+
 	point, _ := influx.NewPoint(
 		"sleep",
 		map[string]string{
@@ -109,3 +115,19 @@ func (a *Architeuthis) writeMetricSleep(duration time.Duration, tag string) {
 	)
 	a.points <- point
 }
+
+func (a *Architeuthis) writeMetricRuleHit(rule *HostRule) {
+	point, _ := influx.NewPoint(
+		"rule",
+		map[string]string{
+			"rule":   rule.Id(),
+			"host":   rule.Host,
+			"action": rule.Action.String(),
+		},
+		map[string]interface{}{
+			"hits": 1,
+		},
+		time.Now(),
+	)
+	a.points <- point
+}
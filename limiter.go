@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"github.com/go-redis/redis_rate/v8"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const PrefixRateLimit = "rate:"
+const PrefixPause = "pause:"
+
+// redis_rate stores its timestamps relative to Jan 1, 2017
+const RedisRateEpoch = 1483228800
+
+// In-process state of a limiter key (host:proxy)
+type limiterState struct {
+	hostKey string
+	proxy   string
+	queue   *fairQueue
+
+	mu    sync.Mutex
+	limit redis_rate.Limit
+	sleep map[string]time.Duration
+}
+
+type limiterStat struct {
+	Key         string             `json:"key"`
+	Host        string             `json:"host"`
+	Proxy       string             `json:"proxy"`
+	Every       string             `json:"every"`
+	Burst       int                `json:"burst"`
+	Remaining   int                `json:"remaining"`
+	NextAllowed time.Time          `json:"next_allowed"`
+	PausedUntil *time.Time         `json:"paused_until,omitempty"`
+	Waiting     int                `json:"waiting"`
+	Sleep       map[string]float64 `json:"sleep"`
+}
+
+func (a *Architeuthis) getLimiterState(hostKey, proxy string) *limiterState {
+	a.limitersMu.Lock()
+	defer a.limitersMu.Unlock()
+
+	key := hostKey + ":" + proxy
+	state, ok := a.limiters[key]
+	if !ok {
+		state = &limiterState{
+			hostKey: hostKey,
+			proxy:   proxy,
+			queue:   newFairQueue(),
+			sleep:   make(map[string]time.Duration),
+		}
+		a.limiters[key] = state
+	}
+	return state
+}
+
+func (s *limiterState) setLimit(limit redis_rate.Limit) {
+	s.mu.Lock()
+	s.limit = limit
+	s.mu.Unlock()
+}
+
+func (a *Architeuthis) addSleep(key string, duration time.Duration, tag string) {
+	a.limitersMu.Lock()
+	state, ok := a.limiters[key]
+	a.limitersMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	state.mu.Lock()
+	state.sleep[tag] += duration
+	state.mu.Unlock()
+}
+
+// Waits until neither the host nor the host:proxy limiter is paused
+func (lim *RedisLimiter) waitPause(ctx context.Context) error {
+	pipe := lim.Redis.Pipeline()
+	hostPause := pipe.PTTL(PrefixPause + lim.HostKey)
+	keyPause := pipe.PTTL(PrefixPause + lim.Key)
+	_, err := pipe.Exec()
+	if err != nil {
+		return err
+	}
+
+	pause := hostPause.Val()
+	if keyPause.Val() > pause {
+		pause = keyPause.Val()
+	}
+
+	if pause > 0 {
+		return sleepCtx(ctx, pause)
+	}
+	return nil
+}
+
+func (a *Architeuthis) getLimiterStats() ([]limiterStat, error) {
+
+	a.limitersMu.Lock()
+	keys := make([]string, 0, len(a.limiters))
+	states := make(map[string]*limiterState, len(a.limiters))
+	for key, state := range a.limiters {
+		keys = append(keys, key)
+		states[key] = state
+	}
+	a.limitersMu.Unlock()
+
+	sort.Strings(keys)
+
+	now, err := a.redis.Time().Result()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]limiterStat, 0, len(keys))
+	for _, key := range keys {
+		state := states[key]
+
+		state.mu.Lock()
+		limit := state.limit
+		sleep := make(map[string]float64, len(state.sleep))
+		for tag, d := range state.sleep {
+			sleep[tag] = d.Seconds()
+		}
+		state.mu.Unlock()
+
+		pipe := a.redis.Pipeline()
+		tatCmd := pipe.Get(PrefixRateLimit + key)
+		hostPause := pipe.PTTL(PrefixPause + state.hostKey)
+		keyPause := pipe.PTTL(PrefixPause + key)
+		_, _ = pipe.Exec()
+
+		stat := limiterStat{
+			Key:     key,
+			Host:    state.hostKey,
+			Proxy:   state.proxy,
+			Every:   limit.Period.String(),
+			Burst:   limit.Burst,
+			Waiting: state.queue.waiting(),
+			Sleep:   sleep,
+		}
+
+		tat, err := strconv.ParseFloat(tatCmd.Val(), 64)
+		if err != nil {
+			tat = 0
+		}
+		stat.Remaining, stat.NextAllowed = limiterAvailability(tat, now, limit)
+
+		pause := hostPause.Val()
+		if keyPause.Val() > pause {
+			pause = keyPause.Val()
+		}
+		if pause > 0 {
+			pausedUntil := now.Add(pause)
+			stat.PausedUntil = &pausedUntil
+		}
+
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
+// Computes the number of requests allowed right now and the time of the
+// next allowed request, from the theoretical arrival time stored by redis_rate
+func limiterAvailability(tat float64, now time.Time, limit redis_rate.Limit) (int, time.Time) {
+
+	if limit.Rate == 0 || limit.Period == 0 {
+		return 0, now
+	}
+
+	nowSec := float64(now.UnixNano())/float64(time.Second) - RedisRateEpoch
+	emission := limit.Period.Seconds() / float64(limit.Rate)
+	burstOffset := emission * float64(limit.Burst)
+
+	if tat <= nowSec {
+		return limit.Burst, now
+	}
+
+	available := int(math.Floor((nowSec - tat + burstOffset) / emission))
+	if available >= 1 {
+		return available, now
+	}
+
+	nextSec := tat - burstOffset + emission
+	return 0, now.Add(time.Duration((nextSec - nowSec) * float64(time.Second)))
+}
+
+// Returns the limiter keys of this host key, for the given proxy or all known proxies
+func (a *Architeuthis) getLimiterKeys(hostKey, proxy string) []string {
+
+	if proxy != "" {
+		return []string{hostKey + ":" + proxy}
+	}
+
+	names := make(map[string]bool)
+	for _, p := range a.GetAliveProxies() {
+		names[p.Name] = true
+	}
+	for _, p := range a.GetDeadProxies() {
+		names[p.Name] = true
+	}
+
+	a.limitersMu.Lock()
+	for _, state := range a.limiters {
+		if state.hostKey == hostKey {
+			names[state.proxy] = true
+		}
+	}
+	a.limitersMu.Unlock()
+
+	keys := make([]string, 0, len(names))
+	for name := range names {
+		keys = append(keys, hostKey+":"+name)
+	}
+	return keys
+}
+
+// Reset the limiter to its initial state (full burst)
+func (a *Architeuthis) resetLimiter(hostKey, proxy string) error {
+
+	keys := a.getLimiterKeys(hostKey, proxy)
+	for i := range keys {
+		keys[i] = PrefixRateLimit + keys[i]
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+	return a.redis.Del(keys...).Err()
+}
+
+// Pause the host (or host:proxy) limiter, a duration of 0 resumes it
+func (a *Architeuthis) pauseLimiter(hostKey, proxy string, duration time.Duration) error {
+
+	key := PrefixPause + hostKey
+	if proxy != "" {
+		key += ":" + proxy
+	}
+
+	if duration <= 0 {
+		return a.redis.Del(key).Err()
+	}
+	return a.redis.Set(key, 1, duration).Err()
+}
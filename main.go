@@ -1,37 +1,76 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/elazarl/goproxy"
 	"github.com/go-redis/redis/v7"
 	influx "github.com/influxdata/influxdb1-client/v2"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 	"html/template"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 func New() *Architeuthis {
 
 	a := new(Architeuthis)
-	a.reloadConfig()
+	a.limiters = make(map[string]*limiterState)
+	a.buckets = make(map[string]*rate.Limiter)
+	a.robots.entries = make(map[string]*robotsCacheEntry)
+	a.ipGroups.entries = make(map[string]ipGroupEntry)
+	handleErr(a.reloadConfig())
+
+	// Metrics are written as soon as proxies are added
+	var err error
+	a.influxdb, err = influx.NewHTTPClient(influx.HTTPConfig{
+		Addr:     getConfig().InfluxUrl,
+		Username: getConfig().InfluxUser,
+		Password: getConfig().InfluxPass,
+	})
+	handleErr(err)
+
+	a.points = make(chan *influx.Point, InfluxDbBufferSize)
+	go a.asyncWriter(a.points)
 
 	a.redis = redis.NewClient(&redis.Options{
-		Addr:     config.RedisUrl,
+		Addr:     getConfig().RedisUrl,
 		Password: "",
 		DB:       0,
 	})
 
+	a.addConfigProxies(getConfig())
+
+	if getConfig().ClusterConfig {
+		handleErr(a.setupClusterConfig())
+	}
+
 	a.setupProxyReviver()
+	if watchConfig {
+		a.setupConfigWatcher()
+	}
 
 	a.server = goproxy.NewProxyHttpServer()
-	a.server.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	a.server.OnRequest().HandleConnectFunc(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			// HTTPS requests only carry Proxy-Authorization on the CONNECT request,
+			// goproxy copies UserData to the requests of the tunnel
+			ctx.UserData = parseProxyAuthUser(ctx.Req.Header.Get("Proxy-Authorization"))
+			return goproxy.MitmConnect, host
+		})
 
 	a.server.OnRequest().DoFunc(
 		func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 
-			resp, err := a.processRequest(r)
+			connectClient, _ := ctx.UserData.(string)
+			resp, err := a.processRequest(r, connectClient)
 
 			if err != nil {
 				logrus.WithError(err).Trace("Could not complete request")
@@ -49,7 +88,12 @@ func New() *Architeuthis {
 	a.server.NonproxyHandler = mux
 
 	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
-		a.reloadConfig()
+		err := a.reloadConfig()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "%s\n", err.Error())
+			return
+		}
 		_, _ = fmt.Fprint(w, "Reloaded\n")
 	})
 
@@ -59,9 +103,135 @@ func New() *Architeuthis {
 		_ = templ.Execute(w, a.getStats())
 	})
 
+	mux.HandleFunc("/limiters", func(w http.ResponseWriter, r *http.Request) {
+		stats, err := a.getLimiterStats()
+		if err != nil {
+			logrus.WithError(err).Error("Could not get limiter stats")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(stats)
+	})
+
+	mux.HandleFunc("/limiters/reset", func(w http.ResponseWriter, r *http.Request) {
+		host := r.URL.Query().Get("host")
+		proxy := r.URL.Query().Get("proxy")
+
+		if host == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err := a.resetLimiter(host, proxy)
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"host":  host,
+				"proxy": proxy,
+			}).Error("Could not reset limiter")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/limiters/pause", func(w http.ResponseWriter, r *http.Request) {
+		host := r.URL.Query().Get("host")
+		proxy := r.URL.Query().Get("proxy")
+		duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+
+		if host == "" || err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err = a.pauseLimiter(host, proxy, duration)
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"host":  host,
+				"proxy": proxy,
+			}).Error("Could not pause limiter")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/rules/test", func(w http.ResponseWriter, r *http.Request) {
+		var input RuleTestInput
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "%s\n", err.Error())
+			return
+		}
+
+		output, err := testRules(input)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "%s\n", err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(output)
+	})
+
+	mux.HandleFunc("/config/history", func(w http.ResponseWriter, r *http.Request) {
+		if !a.clusterConfig {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprint(w, "Cluster config is disabled\n")
+			return
+		}
+
+		history, err := a.getConfigHistory()
+		if err != nil {
+			logrus.WithError(err).Error("Could not get config history")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(history)
+	})
+
+	mux.HandleFunc("/config/rollback", func(w http.ResponseWriter, r *http.Request) {
+		if !a.clusterConfig {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprint(w, "Cluster config is disabled\n")
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		version, err := strconv.ParseInt(r.URL.Query().Get("version"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err = a.rollbackConfig(version)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "%s\n", err.Error())
+			return
+		}
+		_, _ = fmt.Fprintf(w, "Rolled back to version %d (new version: %d)\n", version, getConfig().Version)
+	})
+
+	mux.HandleFunc("/api/hosts", a.handleHostsApi)
+	mux.HandleFunc("/api/hosts/", a.handleHostsApi)
+
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		_, _ = fmt.Fprint(w, "{\"name\":\"Architeuthis\",\"version\":2.1}")
+		cfg := getConfig()
+		_, _ = fmt.Fprintf(w, "{\"name\":\"Architeuthis\",\"version\":2.1,\"config\":\"%s\",\"config_loaded\":\"%s\"}",
+			cfg.Hash, cfg.LoadedAt.Format(time.RFC3339))
 	})
 
 	mux.HandleFunc("/add_proxy", func(w http.ResponseWriter, r *http.Request) {
@@ -73,7 +243,22 @@ func New() *Architeuthis {
 			return
 		}
 
-		err := a.AddProxy(name, url)
+		var maxBps int64
+		if maxBpsStr := r.URL.Query().Get("max_bytes_per_sec"); maxBpsStr != "" {
+			var err error
+			maxBps, err = strconv.ParseInt(maxBpsStr, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		var tags []string
+		if tagsStr := r.URL.Query().Get("tags"); tagsStr != "" {
+			tags = strings.Split(tagsStr, ",")
+		}
+
+		err := a.AddProxy(name, url, maxBps, tags)
 		if err != nil {
 			logrus.WithError(err).WithFields(logrus.Fields{
 				"name": name,
@@ -89,13 +274,12 @@ func New() *Architeuthis {
 	return a
 }
 
-func (a *Architeuthis) processRequest(r *http.Request) (*http.Response, error) {
+func (a *Architeuthis) processRequest(r *http.Request, connectClient string) (*http.Response, error) {
 
-	sHost := normalizeHost(r.Host)
-	configs := getConfigsMatchingHost(sHost)
+	configs := getConfigsMatchingRequest(r)
 
-	options := parseOptions(&r.Header)
-	proxyReq := applyHeaders(cloneRequest(r), configs)
+	options := parseOptions(&r.Header, connectClient)
+	proxyReq := cloneRequest(r)
 
 	requestCtx := RequestCtx{
 		Request:     proxyReq,
@@ -103,12 +287,47 @@ func (a *Architeuthis) processRequest(r *http.Request) (*http.Response, error) {
 		RequestTime: time.Now(),
 		options:     options,
 		configs:     configs,
+		ctx:         r.Context(),
+	}
+
+	status, err := applyRequestRules(&requestCtx)
+	if err != nil {
+		return nil, err
+	}
+	if status != 0 {
+		logrus.WithFields(logrus.Fields{
+			"url":    r.URL.String(),
+			"status": status,
+		}).Trace("Rejected by request rule")
+
+		return goproxy.NewResponse(r, "text/plain", status, "Architeuthis: rejected by request rule\n"),
+			errors.Errorf("Rejected by request rule: %s", r.URL.String())
+	}
+
+	// After the request rules, a rewritten URL might match other configs
+	applyHeaders(proxyReq, requestCtx.configs)
+
+	requestCtx.hostKey = a.getLimiterHostKey(&requestCtx, getMostSpecificConfig(requestCtx.configs))
+
+	allowed, err := a.checkRobotsTxt(&requestCtx)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		logrus.WithFields(logrus.Fields{
+			"url": r.URL.String(),
+		}).Trace("Disallowed by robots.txt")
+
+		return goproxy.NewResponse(r, "text/plain", http.StatusForbidden,
+				"Architeuthis: disallowed by robots.txt\n"),
+			errors.Errorf("Disallowed by robots.txt: %s", r.URL.String())
 	}
 
 	for {
 		responseCtx := a.processRequestWithCtx(&requestCtx)
 
 		a.writeMetricRequest(responseCtx)
+		a.countRuleHits(responseCtx.MatchedRules)
 
 		if requestCtx.p != nil {
 			a.UpdateProxy(requestCtx.p)
@@ -118,30 +337,74 @@ func (a *Architeuthis) processRequest(r *http.Request) (*http.Response, error) {
 			return responseCtx.Response, nil
 		}
 
+		if responseCtx.Canceled {
+			logrus.WithFields(logrus.Fields{
+				"host":    requestCtx.Request.Host,
+				"retries": requestCtx.Retries,
+			}).Trace("Client went away")
+			return responseCtx.Response, responseCtx.Error
+		}
+
 		if !responseCtx.ShouldRetry {
 			return responseCtx.Response, responseCtx.Error
 		}
 	}
 }
 
-func (lim *RedisLimiter) waitRateLimit() (time.Duration, error) {
-	result, err := lim.Limiter.Allow(lim.Key, lim.Limit)
+func (lim *RedisLimiter) waitRateLimit(ctx context.Context, opts RequestOptions) (time.Duration, error) {
+	start := time.Now()
+
+	err := lim.State.queue.acquire(ctx, opts.Client, clientWeight(opts))
 	if err != nil {
-		return 0, err
+		return time.Since(start), err
 	}
+	defer lim.State.queue.release()
 
-	if result.RetryAfter > 0 {
-		time.Sleep(result.RetryAfter)
+	for {
+		err := lim.waitPause(ctx)
+		if err != nil {
+			return time.Since(start), err
+		}
+
+		result, err := lim.Limiter.Allow(lim.Key, lim.Limit)
+		if err != nil {
+			return time.Since(start), err
+		}
+
+		if result.Allowed {
+			return time.Since(start), nil
+		}
+
+		err = sleepCtx(ctx, result.RetryAfter)
+		if err != nil {
+			return time.Since(start), err
+		}
+	}
+}
+
+// Sleeps for the given duration, or until ctx is done
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return result.RetryAfter, nil
 }
 
 func (a *Architeuthis) processRequestWithCtx(rCtx *RequestCtx) ResponseCtx {
 
-	if !rCtx.LastErrorWasProxyError && rCtx.Retries > config.Retries {
-		return ResponseCtx{Error: errors.Errorf("Giving up after %d retries", rCtx.Retries)}
+	rCtx.p = nil
+
+	if err := rCtx.ctx.Err(); err != nil {
+		return ResponseCtx{Error: err, Canceled: true}
 	}
 
+	hostConfig := getMostSpecificConfig(rCtx.configs)
+
 	name, err := a.ChooseProxy(rCtx)
 	if err != nil {
 		return ResponseCtx{Error: err}
@@ -152,7 +415,7 @@ func (a *Architeuthis) processRequestWithCtx(rCtx *RequestCtx) ResponseCtx {
 		"host":  rCtx.Request.Host,
 	}).Info("Routing request")
 
-	p, err := a.GetProxy(name)
+	p, err := a.GetProxy(name, hostConfig.Timeout)
 	if err != nil {
 		return ResponseCtx{Error: err}
 	}
@@ -161,6 +424,7 @@ func (a *Architeuthis) processRequestWithCtx(rCtx *RequestCtx) ResponseCtx {
 	response, err := a.processRequestWithProxy(rCtx)
 
 	responseCtx := ResponseCtx{
+		RequestCtx:   rCtx,
 		Response:     response,
 		ResponseTime: time.Now().Sub(rCtx.RequestTime).Seconds(),
 		Error:        err,
@@ -168,7 +432,24 @@ func (a *Architeuthis) processRequestWithCtx(rCtx *RequestCtx) ResponseCtx {
 
 	p.incrReqTime = responseCtx.ResponseTime
 
+	if rCtx.ctx.Err() != nil {
+		// The client is gone, nobody will read the response
+		if response != nil {
+			_ = response.Body.Close()
+		}
+		responseCtx.Response = nil
+		responseCtx.Error = rCtx.ctx.Err()
+		responseCtx.Canceled = true
+		return responseCtx
+	}
+
 	if response != nil && isHttpSuccessCode(response.StatusCode) {
+		// Rules can still turn a successful response into a failure (e.g. an error page served with 200)
+		a.evaluateRules(rCtx, &responseCtx, false)
+		if responseCtx.Error != nil {
+			rCtx.LastFailedProxy = p.Name
+			return responseCtx
+		}
 		p.incrGood += 1
 		return responseCtx
 	}
@@ -177,54 +458,106 @@ func (a *Architeuthis) processRequestWithCtx(rCtx *RequestCtx) ResponseCtx {
 
 	if isProxyError(err) {
 		a.handleFatalProxyError(p)
-		rCtx.LastErrorWasProxyError = true
 		responseCtx.ShouldRetry = true
+		a.evaluateRules(rCtx, &responseCtx, false)
 		return responseCtx
 	}
 
+	networkError := false
 	if err != nil {
-		if isPermanentError(err) {
-			a.handleProxyError(p, &responseCtx)
-			return responseCtx
-		}
-
-		a.waitAfterFail(rCtx)
 		a.handleProxyError(p, &responseCtx)
-		responseCtx.ShouldRetry = true
+		// Permanent errors (DNS, connection refused...) are only retried if a rule says so
+		responseCtx.ShouldRetry = !isPermanentError(err)
+		networkError = true
 	}
 
-	dontRetry, forceRetry, shouldRetry := computeRules(rCtx, responseCtx)
+	a.evaluateRules(rCtx, &responseCtx, networkError)
+	return responseCtx
+}
+
+// Applies the matching rules to the response, decides whether it should be retried
+// and waits before the retry
+func (a *Architeuthis) evaluateRules(rCtx *RequestCtx, responseCtx *ResponseCtx, networkError bool) {
 
-	if forceRetry {
-		responseCtx.ShouldRetry = true
-		return responseCtx
+	result := computeRules(rCtx, responseCtx)
+	responseCtx.MatchedRules = result.Matched
+	responseCtx.Rule = result.Rule
+	a.applyRuleResult(rCtx, result)
 
-	} else if dontRetry {
-		responseCtx.Error = errors.Errorf("Applied dont_retry rule")
-		return responseCtx
+	decideRetry(rCtx, responseCtx, result)
+
+	if result.Rule != nil {
+		logrus.WithFields(logrus.Fields{
+			"host":   rCtx.Request.Host,
+			"rule":   result.Rule.Id(),
+			"action": result.Rule.Action.String(),
+			"retry":  responseCtx.ShouldRetry,
+		}).Trace("Applied rule")
 	}
 
-	if response == nil {
-		return responseCtx
+	if responseCtx.ShouldRetry {
+		a.waitBeforeRetry(rCtx, responseCtx, retryClass(responseCtx, networkError), result.Wait)
 	}
+}
+
+// Sets the error and the retry decision of the response, according to the rules
+func decideRetry(rCtx *RequestCtx, responseCtx *ResponseCtx, result RuleResult) {
+
+	response := responseCtx.Response
+	success := response != nil && isHttpSuccessCode(response.StatusCode)
 
-	// Handle HTTP errors
-	responseCtx.Error = errors.Errorf("HTTP error: %d", response.StatusCode)
+	if response != nil && !success {
+		// Handle HTTP errors
+		responseCtx.Error = errors.Errorf("HTTP error: %d", response.StatusCode)
+	}
 
-	if shouldRetry || shouldRetryHttpCode(response.StatusCode) {
+	if result.FailWithStatus != 0 {
+		if response != nil {
+			_ = response.Body.Close()
+		}
+		responseCtx.Response = goproxy.NewResponse(rCtx.Request, "text/plain", result.FailWithStatus,
+			fmt.Sprintf("Architeuthis: applied fail_with_status rule (%d)\n", result.FailWithStatus))
+		responseCtx.Error = errors.Errorf("Applied fail_with_status rule")
+		responseCtx.ShouldRetry = false
+		return
+	}
+
+	if result.ForceRetry {
+		responseCtx.ShouldRetry = true
+	} else if result.DontRetry {
+		if !success {
+			responseCtx.Error = errors.Errorf("Applied dont_retry rule")
+		}
+		responseCtx.ShouldRetry = false
+	} else if response != nil && (result.ShouldRetry || shouldRetryHttpCode(response.StatusCode)) {
 		responseCtx.ShouldRetry = true
 	}
 
-	return responseCtx
+	if success && responseCtx.ShouldRetry {
+		responseCtx.Error = errors.Errorf("Applied retry rule (HTTP %d)", response.StatusCode)
+	}
 }
 
-func (a *Architeuthis) waitAfterFail(rCtx *RequestCtx) {
-	wait := getWaitTime(rCtx.Retries)
-	time.Sleep(wait)
+// Side effects of the rules that affect the next attempts
+func (a *Architeuthis) applyRuleResult(rCtx *RequestCtx, result RuleResult) {
 
-	a.writeMetricSleep(wait, "retry")
+	if result.BanProxy > 0 && rCtx.p != nil {
+		err := a.banProxy(rCtx.hostKey, rCtx.p.Name, result.BanProxy)
+		if err != nil {
+			logrus.WithError(err).Error("Could not ban proxy")
+		}
+	}
 
-	rCtx.Retries += 1
+	if result.CooldownHost > 0 {
+		err := a.pauseLimiter(rCtx.hostKey, "", result.CooldownHost)
+		if err != nil {
+			logrus.WithError(err).Error("Could not pause host")
+		}
+	}
+
+	if result.ProxyTag != "" {
+		rCtx.proxyTag = result.ProxyTag
+	}
 }
 
 func isRemoteProxy(p *Proxy) bool {
@@ -248,16 +581,23 @@ func (a *Architeuthis) processRequestWithProxy(rCtx *RequestCtx) (r *http.Respon
 	a.incConns(rCtx.p.Name)
 
 	limiter := a.getLimiter(rCtx)
-	duration, err := limiter.waitRateLimit()
+	duration, err := limiter.waitRateLimit(rCtx.ctx, rCtx.options)
+	if duration > 0 {
+		a.writeMetricSleep(duration, "rate", limiter.Key)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if duration > 0 {
-		a.writeMetricSleep(duration, "rate")
+	client := rCtx.p.HttpClient
+	if isThrottled(rCtx) {
+		client = withoutBodyTimeout(client)
 	}
 
-	r, e = rCtx.p.HttpClient.Do(rCtx.Request)
+	r, e = client.Do(rCtx.Request.WithContext(rCtx.ctx))
+	if r != nil {
+		r.Body = a.throttleBody(rCtx, r.Body)
+	}
 
 	return
 }
@@ -265,31 +605,29 @@ func (a *Architeuthis) processRequestWithProxy(rCtx *RequestCtx) (r *http.Respon
 func (a *Architeuthis) Run() {
 
 	logrus.WithFields(logrus.Fields{
-		"addr": config.Addr,
+		"addr": getConfig().Addr,
 	}).Info("Listening")
 
-	err := http.ListenAndServe(config.Addr, a.server)
+	err := http.ListenAndServe(getConfig().Addr, a.server)
 	logrus.Fatal(err)
 }
 
 func main() {
-	logrus.SetLevel(logrus.TraceLevel)
-
-	balancer := New()
-
-	var err error = nil
-	balancer.influxdb, err = influx.NewHTTPClient(influx.HTTPConfig{
-		Addr:     config.InfluxUrl,
-		Username: config.InfluxUser,
-		Password: config.InfluxPass,
-	})
-	if err != nil {
-		panic(err)
+	if len(os.Args) > 1 && os.Args[1] == "test-rules" {
+		err := runTestRulesCommand(os.Args[2:])
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	balancer.points = make(chan *influx.Point, InfluxDbBufferSize)
+	flag.StringVar(&configPath, "config", DefaultConfigPath, "Path of the config file (JSON or YAML)")
+	flag.BoolVar(&watchConfig, "watch-config", true, "Reload the config when the file changes")
+	flag.Parse()
 
-	go balancer.asyncWriter(balancer.points)
+	logrus.SetLevel(logrus.TraceLevel)
 
+	balancer := New()
 	balancer.Run()
 }
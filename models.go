@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"github.com/elazarl/goproxy"
 	redisPackage "github.com/go-redis/redis/v7"
 	"github.com/go-redis/redis_rate/v8"
 	influx "github.com/influxdata/influxdb1-client/v2"
+	"golang.org/x/net/html"
+	"golang.org/x/time/rate"
 	"math"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -16,32 +22,67 @@ type Architeuthis struct {
 	redis    *redisPackage.Client
 	influxdb influx.Client
 	points   chan *influx.Point
+
+	limiters   map[string]*limiterState
+	limitersMu sync.Mutex
+
+	buckets   map[string]*rate.Limiter
+	bucketsMu sync.Mutex
+
+	robots   robotsCache
+	ipGroups ipGroupCache
+
+	clusterConfig bool
+	configMu      sync.Mutex
+	apiMu         sync.Mutex
+
+	// Config last loaded from the config file, guarded by configMu
+	localConfig *Config
 }
 
 // Request/Response
 type RequestCtx struct {
 	Request *http.Request
 
-	Retries int
+	Retries      int
+	classRetries map[string]int
+	lastWait     time.Duration
 
-	LastFailedProxy        string
-	p                      *Proxy
-	LastErrorWasProxyError bool
+	LastFailedProxy string
+	p               *Proxy
 
 	RequestTime time.Time
 	options     RequestOptions
 	configs     []*HostConfig
+	ctx         context.Context
+	crawlDelay  time.Duration
+	limiterKey  string
+	hostKey     string
+	proxyTag    string
 }
 
 type ResponseCtx struct {
+	RequestCtx   *RequestCtx
 	Response     *http.Response
 	ResponseTime float64
 	Error        error
 	ShouldRetry  bool
+	Canceled     bool
+	MatchedRules []*HostRule
+	Rule         *HostRule
+
+	bodyInspected bool
+	bodyPrefix    []byte
+	jsonParsed    bool
+	json          interface{}
+	htmlParsed    bool
+	html          *html.Node
 }
 
 type RequestOptions struct {
 	DoCloudflareBypass bool
+	Client             string
+	Priority           int
 }
 
 // Proxy
@@ -63,6 +104,9 @@ type Proxy struct {
 	Connections int64
 
 	KillOnError bool
+
+	MaxBytesPerSec int64
+	Tags           []string
 }
 
 func (p *Proxy) AvgLatency() float64 {
@@ -139,6 +183,12 @@ type statsData struct {
 	AvgScore    float64
 
 	Proxies []proxyStat
+	Rules   []ruleStat
+}
+
+type ruleStat struct {
+	Id   string
+	Hits int64
 }
 
 type CheckMethod string
@@ -155,62 +205,205 @@ type ProxyJudge struct {
 
 type RedisLimiter struct {
 	Key     string
+	HostKey string
 	Limiter *redis_rate.Limiter
 	Limit   *redis_rate.Limit
+	State   *limiterState
+	Redis   *redisPackage.Client
 }
 
 // Config
 type HostConfig struct {
-	Host     string            `json:"host"`
-	EveryStr string            `json:"every"`
-	Burst    int               `json:"burst"`
-	Headers  map[string]string `json:"headers"`
-	RawRules []*RawHostRule    `json:"rules"`
-	IsGlob   bool
+	Host             string                     `json:"host"`
+	Scheme           string                     `json:"scheme"`
+	Port             string                     `json:"port"`
+	Path             string                     `json:"path"`
+	Method           string                     `json:"method"`
+	EveryStr         string                     `json:"every"`
+	Burst            int                        `json:"burst"`
+	TimeoutStr       string                     `json:"timeout"`
+	WaitStr          string                     `json:"wait"`
+	Multiplier       float64                    `json:"multiplier"`
+	RawRetries       *int                       `json:"retries"`
+	MaxWaitStr       string                     `json:"max_wait"`
+	Jitter           string                     `json:"jitter"`
+	MaxBytesPerSec   int64                      `json:"max_bytes_per_sec"`
+	Headers          map[string]string          `json:"headers"`
+	RobotsTxt        string                     `json:"robots_txt"`
+	RobotsUserAgent  string                     `json:"robots_user_agent"`
+	BodyInspectSize  int64                      `json:"body_inspect_size"`
+	BodyInspectTypes []string                   `json:"body_inspect_types"`
+	RateGroup        string                     `json:"rate_group"`
+	GroupByIp        int                        `json:"group_by_ip"`
+	RawRules         []*RawHostRule             `json:"rules"`
+	RawSchedule      []*RawScheduleEntry        `json:"schedule"`
+	RawRequestRules  []*RawRequestRule          `json:"request_rules"`
+	RawRetryPolicies map[string]*RawRetryPolicy `json:"retry_policies"`
+	IsGlob           bool
+	Key              string
+	Every            time.Duration
+	Timeout          time.Duration
+	Wait             time.Duration
+	Retries          int
+	MaxWait          time.Duration
+	RetryPolicies    map[string]*RetryPolicy
+	Rules            []*HostRule
+	Schedule         []*ScheduleEntry
+	RequestRules     []*RequestRule
+	rateGroup        *RateGroupConfig
+}
+
+type RawRetryPolicy struct {
+	RawRetries *int    `json:"retries"`
+	WaitStr    string  `json:"wait"`
+	Multiplier float64 `json:"multiplier"`
+}
+
+type RetryPolicy struct {
+	Retries    int
+	Wait       time.Duration
+	Multiplier float64
+}
+
+type RateGroupConfig struct {
+	Name     string `json:"name"`
+	EveryStr string `json:"every"`
+	Burst    int    `json:"burst"`
 	Every    time.Duration
-	Rules    []*HostRule
+}
+
+type RawScheduleEntry struct {
+	Cron     string `json:"cron"`
+	Time     string `json:"time"`
+	Timezone string `json:"timezone"`
+	EveryStr string `json:"every"`
+	Burst    int    `json:"burst"`
+}
+
+type ScheduleEntry struct {
+	Matches func(t time.Time) bool
+	Every   time.Duration
+	Burst   int
 }
 
 type RawHostRule struct {
+	Name      string `json:"name"`
+	Condition string `json:"condition"`
+	Action    string `json:"action"`
+	Arg       string `json:"arg"`
+	Priority  int    `json:"priority"`
+	Stop      bool   `json:"stop"`
+}
+
+type RawRequestRule struct {
 	Condition string `json:"condition"`
 	Action    string `json:"action"`
 	Arg       string `json:"arg"`
+	Replace   string `json:"replace"`
+}
+
+type RequestRuleAction int
+
+const (
+	Reject     RequestRuleAction = 0
+	RewriteUrl RequestRuleAction = 1
+	StripQuery RequestRuleAction = 2
+	UseTag     RequestRuleAction = 3
+)
+
+type RequestRule struct {
+	Matches func(r *ResponseCtx) bool
+	Action  RequestRuleAction
+	Arg     string
+	Status  int
+	Pattern *regexp.Regexp
+	Replace string
+	Keys    []string
 }
 
 type HostRuleAction int
 
 const (
-	DontRetry   HostRuleAction = 0
-	ForceRetry  HostRuleAction = 1
-	ShouldRetry HostRuleAction = 2
+	DontRetry      HostRuleAction = 0
+	ForceRetry     HostRuleAction = 1
+	ShouldRetry    HostRuleAction = 2
+	BanProxy       HostRuleAction = 3
+	CooldownHost   HostRuleAction = 4
+	SetWait        HostRuleAction = 5
+	FailWithStatus HostRuleAction = 6
+	UseProxyTag    HostRuleAction = 7
 )
 
 type HostRule struct {
-	Matches func(r *ResponseCtx) bool
-	Action  HostRuleAction
-	Arg     float64
+	Matches   func(r *ResponseCtx) bool
+	Action    HostRuleAction
+	Arg       string
+	Duration  time.Duration
+	Status    int
+	Condition string
+	Host      string
+	Index     int
+	Name      string
+	Priority  int
+	Stop      bool
+}
+
+// Name of the rule, or <host>#<index> if it doesn't have one
+func (r *HostRule) Id() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Host + "#" + strconv.Itoa(r.Index)
+}
+
+// Combined outcome of the rules that matched a response
+type RuleResult struct {
+	DontRetry      bool
+	ForceRetry     bool
+	ShouldRetry    bool
+	BanProxy       time.Duration
+	CooldownHost   time.Duration
+	Wait           time.Duration
+	FailWithStatus int
+	ProxyTag       string
+	Matched        []*HostRule
+	// Rule that decided whether to retry (or the first rule that matched)
+	Rule *HostRule
 }
 
 type ProxyConfig struct {
-	Name string `json:"name"`
-	Url  string `json:"url"`
-}
-
-var config struct {
-	Addr          string        `json:"addr"`
-	TimeoutStr    string        `json:"timeout"`
-	WaitStr       string        `json:"wait"`
-	Multiplier    float64       `json:"multiplier"`
-	Retries       int           `json:"retries"`
-	MaxErrorRatio float64       `json:"max_error"`
-	Hosts         []*HostConfig `json:"hosts"`
-	Proxies       []ProxyConfig `json:"proxies"`
-	RedisUrl      string        `json:"redis_url"`
-	Wait          int64
-	Timeout       time.Duration
-	DefaultConfig *HostConfig
-	Routing       bool
-	InfluxUrl     string `json:"influx_url"`
-	InfluxUser    string `json:"influx_user"`
-	InfluxPass    string `json:"influx_pass"`
+	Name           string   `json:"name"`
+	Url            string   `json:"url"`
+	MaxBytesPerSec int64    `json:"max_bytes_per_sec"`
+	Tags           []string `json:"tags"`
+}
+
+type Config struct {
+	Addr           string             `json:"addr"`
+	TimeoutStr     string             `json:"timeout"`
+	WaitStr        string             `json:"wait"`
+	Multiplier     float64            `json:"multiplier"`
+	Retries        int                `json:"retries"`
+	MaxErrorRatio  float64            `json:"max_error"`
+	Hosts          []*HostConfig      `json:"hosts"`
+	Proxies        []ProxyConfig      `json:"proxies"`
+	RateGroups     []*RateGroupConfig `json:"rate_groups"`
+	RedisUrl       string             `json:"redis_url"`
+	Wait           int64
+	Timeout        time.Duration
+	DefaultConfig  *HostConfig
+	Routing        bool
+	InfluxUrl      string             `json:"influx_url"`
+	InfluxUser     string             `json:"influx_user"`
+	InfluxPass     string             `json:"influx_pass"`
+	ClientHeader   string             `json:"client_header"`
+	Clients        map[string]float64 `json:"clients"`
+	ClusterConfig  bool               `json:"cluster_config"`
+	SaveApiChanges bool               `json:"save_api_changes"`
+	Hash           string
+	LoadedAt       time.Time
+	// Version in Redis, if the config is shared by the cluster
+	Version int64
+	// Config as it was written, before interpolation
+	raw []byte
 }
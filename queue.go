@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+const DefaultPriority = 1
+const MaxPriority = 10
+
+// Waiting requests of a single limiter, served with start-time
+// weighted fair queueing: each request gets a virtual finish tag and
+// the request with the lowest tag goes next.
+type fairQueue struct {
+	mu          sync.Mutex
+	busy        bool
+	virtualTime float64
+	lastFinish  map[string]float64
+	waiters     []*waiter
+}
+
+type waiter struct {
+	client string
+	tag    float64
+	ready  chan struct{}
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{
+		lastFinish: make(map[string]float64),
+	}
+}
+
+// Blocks until it is this client's turn. Every successful call
+// must be followed by a call to release()
+func (q *fairQueue) acquire(ctx context.Context, client string, weight float64) error {
+
+	q.mu.Lock()
+
+	start := q.virtualTime
+	if q.lastFinish[client] > start {
+		start = q.lastFinish[client]
+	}
+	tag := start + 1/weight
+	q.lastFinish[client] = tag
+
+	if !q.busy {
+		q.busy = true
+		q.virtualTime = start
+		q.mu.Unlock()
+		return nil
+	}
+
+	w := &waiter{
+		client: client,
+		tag:    tag,
+		ready:  make(chan struct{}),
+	}
+	q.waiters = append(q.waiters, w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		removed := q.remove(w)
+		q.mu.Unlock()
+
+		if !removed {
+			// We were handed the turn while giving up, pass it on
+			q.release()
+		}
+		return ctx.Err()
+	}
+}
+
+func (q *fairQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiters) == 0 {
+		q.busy = false
+		// No backlog: forget about past clients
+		q.lastFinish = make(map[string]float64)
+		q.virtualTime = 0
+		return
+	}
+
+	next := 0
+	for i, w := range q.waiters {
+		if w.tag < q.waiters[next].tag {
+			next = i
+		}
+	}
+
+	w := q.waiters[next]
+	q.waiters = append(q.waiters[:next], q.waiters[next+1:]...)
+	q.virtualTime = w.tag
+	close(w.ready)
+}
+
+// Number of requests waiting or currently being rate-limited
+func (q *fairQueue) waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.busy {
+		return len(q.waiters) + 1
+	}
+	return len(q.waiters)
+}
+
+func (q *fairQueue) remove(w *waiter) bool {
+	for i, other := range q.waiters {
+		if other == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func clientWeight(opts RequestOptions) float64 {
+
+	weight, ok := getConfig().Clients[opts.Client]
+	if !ok || weight <= 0 {
+		weight = 1
+	}
+
+	return weight * float64(opts.Priority)
+}
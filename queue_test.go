@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Queues the requests in order behind a request that holds the queue, then
+// returns the clients in the order they are served
+func serveOrder(t *testing.T, requests []RequestOptions) string {
+	t.Helper()
+
+	q := newFairQueue()
+	if err := q.acquire(context.Background(), "holder", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan string)
+	for i, opts := range requests {
+		go func(opts RequestOptions) {
+			if err := q.acquire(context.Background(), opts.Client, clientWeight(opts)); err == nil {
+				served <- opts.Client
+			}
+		}(opts)
+
+		// Wait until it is queued, so that the order is known
+		deadline := time.Now().Add(time.Second)
+		for q.waiting() != i+2 {
+			if time.Now().After(deadline) {
+				t.Fatal("request was not queued")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	order := make([]string, 0, len(requests))
+	for range requests {
+		q.release()
+		order = append(order, <-served)
+	}
+	q.release()
+
+	if q.waiting() != 0 {
+		t.Errorf("expected an empty queue, got %d", q.waiting())
+	}
+	return strings.Join(order, "")
+}
+
+func repeatRequest(opts RequestOptions, n int) []RequestOptions {
+	requests := make([]RequestOptions, n)
+	for i := range requests {
+		requests[i] = opts
+	}
+	return requests
+}
+
+func TestClientWeight(t *testing.T) {
+
+	useTestConfig(t, `{
+		"timeout": "1s", "wait": "0s", "multiplier": 1, "retries": 1,
+		"clients": {"a": 2, "z": 0},
+		"hosts": [{"host": "*", "every": "1s", "burst": 1}]
+	}`)
+
+	tests := []struct {
+		opts     RequestOptions
+		expected float64
+	}{
+		{RequestOptions{Client: "a", Priority: 1}, 2},
+		{RequestOptions{Client: "a", Priority: 3}, 6},
+		{RequestOptions{Client: "b", Priority: 1}, 1},
+		{RequestOptions{Client: "b", Priority: MaxPriority}, 10},
+		{RequestOptions{Client: "z", Priority: 2}, 2},
+	}
+
+	for _, test := range tests {
+		if weight := clientWeight(test.opts); weight != test.expected {
+			t.Errorf("%+v: expected %v, got %v", test.opts, test.expected, weight)
+		}
+	}
+}
+
+func TestFairQueueOrder(t *testing.T) {
+
+	useTestConfig(t, `{
+		"timeout": "1s", "wait": "0s", "multiplier": 1, "retries": 1,
+		"clients": {"a": 2},
+		"hosts": [{"host": "*", "every": "1s", "burst": 1}]
+	}`)
+
+	a := RequestOptions{Client: "a", Priority: DefaultPriority}
+	b := RequestOptions{Client: "b", Priority: DefaultPriority}
+	c := RequestOptions{Client: "c", Priority: DefaultPriority}
+	urgent := RequestOptions{Client: "u", Priority: MaxPriority}
+	high := RequestOptions{Client: "h", Priority: 4}
+
+	tests := []struct {
+		name     string
+		requests []RequestOptions
+		expected string
+	}{
+		{"single client keeps its order", repeatRequest(b, 3), "bbb"},
+		{"equal weights alternate", append(repeatRequest(b, 3), repeatRequest(c, 3)...), "bcbcbc"},
+		// a has twice the weight of b, the earlier request wins a tie
+		{"weighted", append(repeatRequest(b, 3), repeatRequest(a, 6)...), "abaabaaba"},
+		{"priority goes first", append(repeatRequest(b, 3), urgent), "ubbb"},
+		{"priority is weighted", append(repeatRequest(b, 2), repeatRequest(high, 8)...), "hhhbhhhhbh"},
+	}
+
+	for _, test := range tests {
+		if order := serveOrder(t, test.requests); order != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, order)
+		}
+	}
+}
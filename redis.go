@@ -9,7 +9,10 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const KeyProxyList = "proxies"
@@ -22,24 +25,46 @@ const KeyBadRequestCount = "bad"
 const KeyGoodRequestCount = "good"
 const KeyRevived = "revived"
 const KeyUrl = "url"
+const KeyMaxBytesPerSec = "maxbps"
+const KeyTags = "tags"
+const KeyRuleHits = "ruleHits"
+const PrefixBan = "ban:"
+
+// Number of proxies to choose from in ChooseProxy
+const ProxyChoiceCount = 13
 
 func (a *Architeuthis) getLimiter(rCtx *RequestCtx) *RedisLimiter {
 
-	var hostConfig *HostConfig
-	if len(rCtx.configs) == 0 {
-		hostConfig = config.DefaultConfig
-	} else {
-		hostConfig = rCtx.configs[len(rCtx.configs)-1]
+	hostConfig := getMostSpecificConfig(rCtx.configs)
+
+	every, burst := hostConfig.activeLimit(time.Now())
+	if hostConfig.rateGroup != nil {
+		every, burst = hostConfig.rateGroup.Every, hostConfig.rateGroup.Burst
 	}
+	if rCtx.crawlDelay > every {
+		every = rCtx.crawlDelay
+	}
+
+	hostKey := rCtx.hostKey
+	key := hostKey + ":" + rCtx.p.Name
+	rCtx.limiterKey = key
+
+	limit := &redis_rate.Limit{
+		Rate:   1,
+		Period: every,
+		Burst:  burst,
+	}
+
+	state := a.getLimiterState(hostKey, rCtx.p.Name)
+	state.setLimit(*limit)
 
 	return &RedisLimiter{
-		Key:     hostConfig.Host + ":" + rCtx.p.Name,
+		Key:     key,
+		HostKey: hostKey,
 		Limiter: redis_rate.NewLimiter(a.redis),
-		Limit: &redis_rate.Limit{
-			Rate:   1,
-			Period: hostConfig.Every,
-			Burst:  hostConfig.Burst,
-		},
+		Limit:   limit,
+		State:   state,
+		Redis:   a.redis,
 	}
 }
 
@@ -74,39 +99,87 @@ func (a *Architeuthis) UpdateProxy(p *Proxy) {
 
 	newBadRatio := float64(p.BadRequestCount) / float64(p.GoodRequestCount)
 
-	if p.incrBad > 0 && (p.KillOnError || (newBadRatio > config.MaxErrorRatio && p.BadRequestCount >= 5)) {
+	if p.incrBad > 0 && (p.KillOnError || (newBadRatio > getConfig().MaxErrorRatio && p.BadRequestCount >= 5)) {
 		a.setDead(p.Name)
 	}
 }
 
-func (a *Architeuthis) AddProxy(name, stringUrl string) error {
+// Adds the proxy, or resets its stats and revives it if it already exists
+func (a *Architeuthis) AddProxy(name, stringUrl string, maxBytesPerSec int64, tags []string) error {
+	return a.addProxy(name, stringUrl, maxBytesPerSec, tags, false)
+}
+
+// Adds the proxies of the config. Proxies that already exist (e.g. after a restart)
+// keep their stats, and dead proxies are not revived
+func (a *Architeuthis) addConfigProxies(cfg *Config) {
+	for _, p := range cfg.Proxies {
+		err := a.addProxy(p.Name, p.Url, p.MaxBytesPerSec, p.Tags, true)
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"name": p.Name,
+				"url":  p.Url,
+			}).Error("Could not add proxy")
+		}
+	}
+}
+
+func (a *Architeuthis) addProxy(name, stringUrl string, maxBytesPerSec int64, tags []string, keepStats bool) error {
 
 	_, err := url.Parse(stringUrl)
 	if err != nil {
 		return err
 	}
 
+	dead := false
+	if keepStats {
+		dead, err = a.redis.SIsMember(KeyDeadProxyList, name).Result()
+		if err != nil {
+			return err
+		}
+	}
+
 	pipe := a.redis.Pipeline()
 
-	pipe.HMSet(PrefixProxy+name, map[string]interface{}{
-		KeyUrl:              stringUrl,
-		KeyRequestTime:      0,
-		KeyGoodRequestCount: 0,
-		KeyBadRequestCount:  0,
-		KeyConnectionCount:  0,
-		KeyRevived:          0,
-	})
+	var zadd *redis.IntCmd
+	if keepStats {
+		pipe.HMSet(PrefixProxy+name, map[string]interface{}{
+			KeyUrl:            stringUrl,
+			KeyMaxBytesPerSec: maxBytesPerSec,
+			KeyTags:           strings.Join(tags, ","),
+		})
+		for _, key := range []string{KeyRequestTime, KeyGoodRequestCount, KeyBadRequestCount, KeyConnectionCount, KeyRevived} {
+			pipe.HSetNX(PrefixProxy+name, key, 0)
+		}
 
-	zadd := pipe.ZAdd(KeyProxyList, &redis.Z{
-		Score:  1000,
-		Member: name,
-	})
+		if !dead {
+			zadd = pipe.ZAddNX(KeyProxyList, &redis.Z{
+				Score:  1000,
+				Member: name,
+			})
+		}
+	} else {
+		pipe.HMSet(PrefixProxy+name, map[string]interface{}{
+			KeyUrl:              stringUrl,
+			KeyRequestTime:      0,
+			KeyGoodRequestCount: 0,
+			KeyBadRequestCount:  0,
+			KeyConnectionCount:  0,
+			KeyRevived:          0,
+			KeyMaxBytesPerSec:   maxBytesPerSec,
+			KeyTags:             strings.Join(tags, ","),
+		})
+
+		zadd = pipe.ZAdd(KeyProxyList, &redis.Z{
+			Score:  1000,
+			Member: name,
+		})
+	}
 
 	zcard := pipe.ZCard(KeyProxyList)
 
 	_, _ = pipe.Exec()
 
-	if zadd.Val() != 0 {
+	if zadd != nil && zadd.Val() != 0 {
 		logrus.WithFields(logrus.Fields{
 			KeyUrl: stringUrl,
 		}).Info("Add proxy")
@@ -191,7 +264,7 @@ func (a *Architeuthis) getProxies(names []string) []*Proxy {
 	var proxies []*Proxy
 
 	for _, name := range names {
-		p, _ := a.GetProxy(name)
+		p, _ := a.GetProxy(name, getConfig().Timeout)
 		if p != nil {
 			proxies = append(proxies, p)
 		}
@@ -219,13 +292,48 @@ func (a *Architeuthis) getStats() statsData {
 		totalScore += stat.Score
 	}
 
+	data.Rules = a.getRuleStats()
+
 	data.AvgLatency = totalTime / float64(data.TotalGood+data.TotalBad)
 	data.AvgScore = float64(totalScore) / float64(len(data.Proxies))
 
 	return data
 }
 
-func (a *Architeuthis) GetProxy(name string) (*Proxy, error) {
+func (a *Architeuthis) countRuleHits(rules []*HostRule) {
+
+	if len(rules) == 0 {
+		return
+	}
+
+	pipe := a.redis.Pipeline()
+	for _, rule := range rules {
+		pipe.HIncrBy(KeyRuleHits, rule.Id(), 1)
+		a.writeMetricRuleHit(rule)
+	}
+	_, _ = pipe.Exec()
+}
+
+func (a *Architeuthis) getRuleStats() []ruleStat {
+
+	result, err := a.redis.HGetAll(KeyRuleHits).Result()
+	if err != nil {
+		return nil
+	}
+
+	var stats []ruleStat
+	for id, hitsStr := range result {
+		hits, _ := strconv.ParseInt(hitsStr, 10, 64)
+		stats = append(stats, ruleStat{Id: id, Hits: hits})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Id < stats[j].Id
+	})
+	return stats
+}
+
+func (a *Architeuthis) GetProxy(name string, timeout time.Duration) (*Proxy, error) {
 
 	result, err := a.redis.HGetAll(PrefixProxy + name).Result()
 	if err != nil {
@@ -238,7 +346,7 @@ func (a *Architeuthis) GetProxy(name string) (*Proxy, error) {
 	if result[KeyUrl] == "" {
 		parsedUrl = nil
 		httpClient = &http.Client{
-			Timeout: config.Timeout,
+			Timeout: timeout,
 		}
 	} else {
 		parsedUrl, err = url.Parse(result[KeyUrl])
@@ -250,7 +358,7 @@ func (a *Architeuthis) GetProxy(name string) (*Proxy, error) {
 			Transport: &http.Transport{
 				Proxy: http.ProxyURL(parsedUrl),
 			},
-			Timeout: config.Timeout,
+			Timeout: timeout,
 		}
 	}
 
@@ -258,6 +366,12 @@ func (a *Architeuthis) GetProxy(name string) (*Proxy, error) {
 	good, _ := strconv.ParseInt(result[KeyGoodRequestCount], 10, 64)
 	bad, _ := strconv.ParseInt(result[KeyBadRequestCount], 10, 64)
 	reqtime, _ := strconv.ParseFloat(result[KeyRequestTime], 64)
+	maxBps, _ := strconv.ParseInt(result[KeyMaxBytesPerSec], 10, 64)
+
+	var tags []string
+	if result[KeyTags] != "" {
+		tags = strings.Split(result[KeyTags], ",")
+	}
 
 	return &Proxy{
 		Name:             name,
@@ -267,28 +381,108 @@ func (a *Architeuthis) GetProxy(name string) (*Proxy, error) {
 		GoodRequestCount: good,
 		BadRequestCount:  bad,
 		TotalRequestTime: reqtime,
+		MaxBytesPerSec:   maxBps,
+		Tags:             tags,
 	}, nil
 }
 
 func (a *Architeuthis) ChooseProxy(rCtx *RequestCtx) (string, error) {
-	results, err := a.redis.ZRevRangeWithScores(KeyProxyList, 0, 12).Result()
-	if err != nil {
-		return "", err
+
+	var candidates []string
+	var start int64 = 0
+
+	// Go down the list until there are enough proxies that are not banned
+	// for this host (and have the requested tag)
+	for len(candidates) < ProxyChoiceCount {
+		results, err := a.redis.ZRevRange(KeyProxyList, start, start+ProxyChoiceCount-1).Result()
+		if err != nil {
+			return "", err
+		}
+
+		filtered, err := a.filterProxies(rCtx, results)
+		if err != nil {
+			return "", err
+		}
+		candidates = append(candidates, filtered...)
+
+		if len(results) < ProxyChoiceCount {
+			break
+		}
+		start += ProxyChoiceCount
+	}
+
+	if len(candidates) > ProxyChoiceCount {
+		candidates = candidates[:ProxyChoiceCount]
 	}
 
-	if len(results) == 0 {
+	if len(candidates) == 0 {
+		if rCtx.proxyTag != "" {
+			return "", errors.New("no proxies available with tag " + rCtx.proxyTag)
+		}
 		return "", errors.New("no proxies available")
 	}
 
-	if len(results) == 1 {
-		return results[0].Member.(string), nil
+	if len(candidates) == 1 {
+		return candidates[0], nil
 	}
 
 	for {
-		idx := rand.Intn(len(results))
+		idx := rand.Intn(len(candidates))
+
+		if candidates[idx] != rCtx.LastFailedProxy {
+			return candidates[idx], nil
+		}
+	}
+}
+
+func (a *Architeuthis) filterProxies(rCtx *RequestCtx, names []string) ([]string, error) {
+
+	pipe := a.redis.Pipeline()
+
+	banned := make([]*redis.IntCmd, len(names))
+	tags := make([]*redis.StringCmd, len(names))
+	for i, name := range names {
+		banned[i] = pipe.Exists(PrefixBan + rCtx.hostKey + ":" + name)
+		if rCtx.proxyTag != "" {
+			tags[i] = pipe.HGet(PrefixProxy+name, KeyTags)
+		}
+	}
+
+	_, err := pipe.Exec()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	var filtered []string
+	for i, name := range names {
+		if banned[i].Val() != 0 {
+			continue
+		}
+		if rCtx.proxyTag != "" && !hasTag(tags[i].Val(), rCtx.proxyTag) {
+			continue
+		}
+		filtered = append(filtered, name)
+	}
+	return filtered, nil
+}
 
-		if results[idx].Member != rCtx.LastFailedProxy {
-			return results[idx].Member.(string), nil
+func hasTag(tags string, tag string) bool {
+	for _, t := range strings.Split(tags, ",") {
+		if t == tag {
+			return true
 		}
 	}
+	return false
+}
+
+// Don't use this proxy for this host (limiter host key) for the given duration
+func (a *Architeuthis) banProxy(hostKey, name string, duration time.Duration) error {
+
+	logrus.WithFields(logrus.Fields{
+		"proxy":    name,
+		"host":     hostKey,
+		"duration": duration,
+	}).Info("Ban proxy")
+
+	return a.redis.Set(PrefixBan+hostKey+":"+name, 1, duration).Err()
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Error classes with their own retry policy
+const RetryNetwork = "network"
+const RetryProxy = "proxy"
+const Retry5xx = "5xx"
+const Retry429 = "429"
+const Retry2xx = "2xx"
+
+const JitterNone = "none"
+const JitterFull = "full"
+const JitterDecorrelated = "decorrelated"
+
+var retryClasses = []string{RetryNetwork, RetryProxy, Retry5xx, Retry429, Retry2xx}
+
+func isRetryClass(class string) bool {
+	for _, c := range retryClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Class of a failed attempt, empty if it has no retry policy
+func retryClass(responseCtx *ResponseCtx, networkError bool) string {
+
+	if isProxyError(responseCtx.Error) {
+		return RetryProxy
+	}
+	if networkError {
+		return RetryNetwork
+	}
+	if responseCtx.Response == nil {
+		return ""
+	}
+
+	switch status := responseCtx.Response.StatusCode; {
+	case isHttpSuccessCode(status):
+		// Retried by a rule (e.g. an error page served with 200)
+		return Retry2xx
+	case status == 429:
+		return Retry429
+	case status >= 500:
+		return Retry5xx
+	}
+	return ""
+}
+
+// Resolves the retry policies of a host config. Unset fields of a policy
+// default to the retries, wait & multiplier of the host
+func parseRetryPolicies(conf *HostConfig) (map[string]*RetryPolicy, error) {
+
+	policies := make(map[string]*RetryPolicy)
+
+	for class, raw := range conf.RawRetryPolicies {
+		if !isRetryClass(class) {
+			return nil, errors.Errorf("Invalid retry policy: %s (expected one of %v)", class, retryClasses)
+		}
+
+		policy := &RetryPolicy{
+			Retries:    conf.Retries,
+			Wait:       conf.Wait,
+			Multiplier: raw.Multiplier,
+		}
+		if raw.RawRetries != nil {
+			policy.Retries = *raw.RawRetries
+		}
+		if policy.Retries < 0 {
+			return nil, errors.Errorf("retries must be >= 0 (Retry policy: %s)", class)
+		}
+		if raw.WaitStr != "" {
+			var err error
+			policy.Wait, err = time.ParseDuration(raw.WaitStr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid wait (Retry policy: %s)", class)
+			}
+		}
+		if policy.Multiplier == 0 {
+			policy.Multiplier = conf.Multiplier
+		}
+		policies[class] = policy
+	}
+
+	return policies, nil
+}
+
+// Backoff before the next retry: wait * multiplier^retries, with jitter and capped at max_wait
+func getWaitTime(hostConfig *HostConfig, policy *RetryPolicy, retries int, lastWait time.Duration) time.Duration {
+
+	wait := float64(policy.Wait) * math.Pow(policy.Multiplier, float64(retries))
+	if hostConfig.MaxWait > 0 {
+		wait = math.Min(wait, float64(hostConfig.MaxWait))
+	}
+	wait = math.Min(wait, math.MaxInt64)
+
+	switch hostConfig.Jitter {
+	case JitterFull:
+		// random_between(0, min(max_wait, wait * multiplier^retries))
+		wait = rand.Float64() * wait
+	case JitterDecorrelated:
+		// min(max_wait, random_between(wait, last wait * 3))
+		base := float64(policy.Wait)
+		upper := math.Max(base, float64(lastWait)*3)
+		wait = base + rand.Float64()*(upper-base)
+		if hostConfig.MaxWait > 0 {
+			wait = math.Min(wait, float64(hostConfig.MaxWait))
+		}
+	}
+
+	if wait >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(wait)
+}
+
+// Retry policy of an error class. Classes without their own policy have
+// the retries, wait & multiplier of the host
+func (conf *HostConfig) retryPolicy(class string) *RetryPolicy {
+
+	if policy, ok := conf.RetryPolicies[class]; ok {
+		return policy
+	}
+	return &RetryPolicy{
+		Retries:    conf.Retries,
+		Wait:       conf.Wait,
+		Multiplier: conf.Multiplier,
+	}
+}
+
+func retryClassName(class string) string {
+	if class == "" {
+		return "http"
+	}
+	return class
+}
+
+// Counts the retry and sleeps before it, see countRetry
+func (a *Architeuthis) waitBeforeRetry(rCtx *RequestCtx, responseCtx *ResponseCtx, class string, wait time.Duration) {
+
+	wait = countRetry(rCtx, responseCtx, class, wait)
+	if wait <= 0 {
+		return
+	}
+
+	start := time.Now()
+	err := sleepCtx(rCtx.ctx, wait)
+
+	a.writeMetricSleep(time.Since(start), "retry", rCtx.limiterKey)
+	if err != nil {
+		responseCtx.Error = err
+		responseCtx.Canceled = true
+	}
+}
+
+// Counts the retry against the policy of its error class and returns how long
+// to wait before it. wait overrides the backoff of the policy if > 0. Gives up
+// if the class has no retries left
+func countRetry(rCtx *RequestCtx, responseCtx *ResponseCtx, class string, wait time.Duration) time.Duration {
+
+	hostConfig := getMostSpecificConfig(rCtx.configs)
+	policy := hostConfig.retryPolicy(class)
+
+	retries := rCtx.classRetries[class]
+	if retries >= policy.Retries {
+		responseCtx.ShouldRetry = false
+		responseCtx.Error = errors.Errorf("Giving up after %d retries (%s)", retries, retryClassName(class))
+		return 0
+	}
+
+	if wait <= 0 {
+		wait = getWaitTime(hostConfig, policy, retries, rCtx.lastWait)
+	}
+	if rCtx.classRetries == nil {
+		rCtx.classRetries = make(map[string]int)
+	}
+	rCtx.classRetries[class] = retries + 1
+	rCtx.Retries += 1
+
+	if wait > 0 {
+		rCtx.lastWait = wait
+	}
+	return wait
+}
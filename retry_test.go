@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Parses and activates the config
+func useTestConfig(t *testing.T, raw string) *Config {
+	t.Helper()
+
+	cfg, err := loadConfigBytes([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeConfig.Store(cfg)
+	return cfg
+}
+
+func testRequestCtx(t *testing.T, method, rawUrl string) *RequestCtx {
+	t.Helper()
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &http.Request{Method: method, URL: u, Host: u.Host, Header: http.Header{}}
+	return &RequestCtx{Request: r, configs: getConfigsMatchingRequest(r)}
+}
+
+func TestRetriesOperand(t *testing.T) {
+
+	useTestConfig(t, `{
+		"timeout": "1s", "wait": "0s", "multiplier": 1, "retries": 5,
+		"hosts": [{"host": "*", "every": "1s", "burst": 1}]
+	}`)
+
+	a := &Architeuthis{}
+	rCtx := testRequestCtx(t, "GET", "http://example.com/")
+
+	// 403 has no retry policy, it is still counted
+	for i := 0; i < 3; i++ {
+		responseCtx := ResponseCtx{RequestCtx: rCtx, Response: &http.Response{StatusCode: 403, Header: http.Header{}}}
+		a.evaluateRules(rCtx, &responseCtx, false)
+		if !responseCtx.ShouldRetry {
+			t.Fatalf("retry %d: expected a retry", i)
+		}
+	}
+
+	ctx := &ResponseCtx{RequestCtx: rCtx}
+	if !evalCondition(t, "retries>2", ctx) || evalCondition(t, "retries>3", ctx) {
+		t.Errorf("expected 3 retries, got %d", rCtx.Retries)
+	}
+}
+
+func TestRetrySuccessfulResponseIsCapped(t *testing.T) {
+
+	useTestConfig(t, `{
+		"timeout": "1s", "wait": "0s", "multiplier": 1, "retries": 10,
+		"hosts": [{
+			"host": "*", "every": "1s", "burst": 1, "retries": 2,
+			"rules": [{"condition": "status=200", "action": "force_retry"}]
+		}]
+	}`)
+
+	a := &Architeuthis{}
+	rCtx := testRequestCtx(t, "GET", "http://example.com/")
+
+	attempts := 0
+	for {
+		attempts++
+		if attempts > 10 {
+			t.Fatal("expected the retries to be capped")
+		}
+
+		responseCtx := ResponseCtx{RequestCtx: rCtx, Response: &http.Response{StatusCode: 200, Header: http.Header{}}}
+		a.evaluateRules(rCtx, &responseCtx, false)
+		if responseCtx.Error == nil {
+			t.Fatal("expected an error")
+		}
+		if !responseCtx.ShouldRetry {
+			if responseCtx.Error.Error() != "Giving up after 2 retries (2xx)" {
+				t.Errorf("unexpected error: %v", responseCtx.Error)
+			}
+			break
+		}
+	}
+
+	if attempts != 3 || rCtx.Retries != 2 {
+		t.Errorf("expected 3 attempts and 2 retries, got %d and %d", attempts, rCtx.Retries)
+	}
+}
+
+func TestGetWaitTime(t *testing.T) {
+
+	const s = time.Second
+
+	tests := []struct {
+		jitter   string
+		maxWait  time.Duration
+		retries  int
+		lastWait time.Duration
+		min      time.Duration
+		max      time.Duration
+	}{
+		// wait: 1s, multiplier: 2
+		{JitterNone, 0, 0, 0, 1 * s, 1 * s},
+		{JitterNone, 0, 3, 0, 8 * s, 8 * s},
+		{"", 0, 3, 0, 8 * s, 8 * s},
+		{JitterNone, 5 * s, 3, 0, 5 * s, 5 * s},
+		{JitterNone, 5 * s, 100, 0, 5 * s, 5 * s},
+		{JitterNone, 0, 100, 0, math.MaxInt64, math.MaxInt64},
+		{JitterFull, 0, 0, 0, 0, 1 * s},
+		{JitterFull, 0, 3, 0, 0, 8 * s},
+		{JitterFull, 5 * s, 3, 0, 0, 5 * s},
+		// Between wait and 3 times the last wait
+		{JitterDecorrelated, 0, 0, 0, 1 * s, 1 * s},
+		{JitterDecorrelated, 0, 1, 2 * s, 1 * s, 6 * s},
+		{JitterDecorrelated, 0, 5, 10 * s, 1 * s, 30 * s},
+		{JitterDecorrelated, 4 * s, 5, 10 * s, 1 * s, 4 * s},
+	}
+
+	policy := &RetryPolicy{Wait: 1 * s, Multiplier: 2}
+
+	for _, test := range tests {
+		hostConfig := &HostConfig{Jitter: test.jitter, MaxWait: test.maxWait}
+		for i := 0; i < 100; i++ {
+			wait := getWaitTime(hostConfig, policy, test.retries, test.lastWait)
+			if wait < test.min || wait > test.max {
+				t.Errorf("%s (max_wait: %s, retries: %d, last wait: %s): expected %s-%s, got %s",
+					test.jitter, test.maxWait, test.retries, test.lastWait, test.min, test.max, wait)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RobotsTxtCacheTime = time.Hour
+const RobotsTxtErrorCacheTime = time.Minute
+const RobotsTxtMaxSize = 512 * 1024
+
+const (
+	RobotsObey   = "obey"
+	RobotsIgnore = "ignore"
+)
+
+type robotsRule struct {
+	pattern string
+	allow   bool
+}
+
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+type robotsTxt struct {
+	groups []*robotsGroup
+	// robots.txt could not be fetched
+	disallowAll bool
+}
+
+type robotsCacheEntry struct {
+	robots  *robotsTxt
+	expires time.Time
+	ready   chan struct{}
+}
+
+type robotsCache struct {
+	mu      sync.Mutex
+	entries map[string]*robotsCacheEntry
+}
+
+func parseRobotsTxt(r io.Reader) *robotsTxt {
+
+	robots := &robotsTxt{}
+	var group *robotsGroup
+	lastWasAgent := false
+
+	scanner := bufio.NewScanner(io.LimitReader(r, RobotsTxtMaxSize))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+
+		col := strings.Index(line, ":")
+		if col < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:col]))
+		value := strings.TrimSpace(line[col+1:])
+
+		switch key {
+		case "user-agent":
+			if group == nil || !lastWasAgent {
+				group = &robotsGroup{}
+				robots.groups = append(robots.groups, group)
+			}
+			group.agents = append(group.agents, strings.ToLower(value))
+			lastWasAgent = true
+			continue
+		case "allow", "disallow":
+			if group != nil && value != "" {
+				group.rules = append(group.rules, robotsRule{
+					pattern: value,
+					allow:   key == "allow",
+				})
+			}
+		case "crawl-delay":
+			delay, err := strconv.ParseFloat(value, 64)
+			if group != nil && err == nil && delay > 0 {
+				group.crawlDelay = time.Duration(delay * float64(time.Second))
+			}
+		}
+		lastWasAgent = false
+	}
+
+	return robots
+}
+
+// Find the group that applies to this user-agent token, or the '*' group
+func (r *robotsTxt) findGroup(userAgent string) *robotsGroup {
+
+	userAgent = strings.ToLower(userAgent)
+
+	var fallback *robotsGroup
+	for _, group := range r.groups {
+		for _, agent := range group.agents {
+			if agent == "*" {
+				if fallback == nil {
+					fallback = group
+				}
+			} else if strings.Contains(userAgent, agent) {
+				return group
+			}
+		}
+	}
+	return fallback
+}
+
+// The longest matching pattern wins, allow wins in case of a tie
+func (r *robotsTxt) isAllowed(userAgent, path string) bool {
+
+	if path == "/robots.txt" {
+		return true
+	}
+	if r.disallowAll {
+		return false
+	}
+
+	group := r.findGroup(userAgent)
+	if group == nil {
+		return true
+	}
+
+	allowed := true
+	matchLen := -1
+	for _, rule := range group.rules {
+		if !robotsPatternMatches(rule.pattern, path) {
+			continue
+		}
+		if len(rule.pattern) > matchLen || (len(rule.pattern) == matchLen && rule.allow) {
+			matchLen = len(rule.pattern)
+			allowed = rule.allow
+		}
+	}
+	return allowed
+}
+
+func (r *robotsTxt) crawlDelay(userAgent string) time.Duration {
+	group := r.findGroup(userAgent)
+	if group == nil {
+		return 0
+	}
+	return group.crawlDelay
+}
+
+// Prefix match with support for the '*' and '$' wildcards
+func robotsPatternMatches(pattern, path string) bool {
+
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	pos := len(parts[0])
+
+	for i, part := range parts[1:] {
+		if anchored && i == len(parts)-2 {
+			return strings.HasSuffix(path[pos:], part)
+		}
+		idx := strings.Index(path[pos:], part)
+		if idx < 0 {
+			return false
+		}
+		pos += idx + len(part)
+	}
+
+	return !anchored || pos == len(path)
+}
+
+func (a *Architeuthis) getRobotsTxt(rCtx *RequestCtx) (*robotsTxt, error) {
+
+	u := rCtx.Request.URL
+	key := u.Scheme + "://" + u.Host
+
+	for {
+		a.robots.mu.Lock()
+		entry, ok := a.robots.entries[key]
+		if ok && (entry.expires.IsZero() || time.Now().Before(entry.expires)) {
+			a.robots.mu.Unlock()
+
+			// Another request might be fetching it
+			select {
+			case <-entry.ready:
+				if entry.robots != nil {
+					return entry.robots, nil
+				}
+				// That request was canceled, fetch it again
+				continue
+			case <-rCtx.ctx.Done():
+				return nil, rCtx.ctx.Err()
+			}
+		}
+
+		entry = &robotsCacheEntry{ready: make(chan struct{})}
+		a.robots.entries[key] = entry
+		a.robots.mu.Unlock()
+
+		robots, cacheTime, err := a.fetchRobotsTxt(rCtx, key+"/robots.txt")
+
+		a.robots.mu.Lock()
+		if err != nil {
+			if a.robots.entries[key] == entry {
+				delete(a.robots.entries, key)
+			}
+		} else {
+			entry.robots = robots
+			entry.expires = time.Now().Add(cacheTime)
+		}
+		a.robots.mu.Unlock()
+		close(entry.ready)
+
+		return robots, err
+	}
+}
+
+// Fetches robots.txt through a proxy chosen for the request, with the rate limiter
+// of the host. If it can't be fetched (network error, 5xx), everything is disallowed.
+// Only returns an error if the request was canceled
+func (a *Architeuthis) fetchRobotsTxt(rCtx *RequestCtx, robotsUrl string) (*robotsTxt, time.Duration, error) {
+
+	req, err := http.NewRequest("GET", robotsUrl, nil)
+	if err != nil {
+		return &robotsTxt{disallowAll: true}, RobotsTxtErrorCacheTime, nil
+	}
+	req.Header.Set("User-Agent", rCtx.Request.Header.Get("User-Agent"))
+
+	robotsCtx := *rCtx
+	robotsCtx.Request = req
+
+	name, err := a.ChooseProxy(&robotsCtx)
+	if err == nil {
+		robotsCtx.p, err = a.GetProxy(name, getMostSpecificConfig(rCtx.configs).Timeout)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("url", robotsUrl).Warn("Could not fetch robots.txt")
+		return &robotsTxt{disallowAll: true}, RobotsTxtErrorCacheTime, nil
+	}
+
+	resp, err := a.processRequestWithProxy(&robotsCtx)
+	// Releases the connection, like processRequest does
+	a.UpdateProxy(robotsCtx.p)
+	if rCtx.ctx.Err() != nil {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		return nil, 0, rCtx.ctx.Err()
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("url", robotsUrl).Warn("Could not fetch robots.txt")
+		return &robotsTxt{disallowAll: true}, RobotsTxtErrorCacheTime, nil
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case isHttpSuccessCode(resp.StatusCode):
+		return parseRobotsTxt(resp.Body), RobotsTxtCacheTime, nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		// No robots.txt: everything is allowed
+		return &robotsTxt{}, RobotsTxtCacheTime, nil
+	default:
+		logrus.WithFields(logrus.Fields{
+			"url":    robotsUrl,
+			"status": resp.StatusCode,
+		}).Warn("Could not fetch robots.txt")
+		return &robotsTxt{disallowAll: true}, RobotsTxtErrorCacheTime, nil
+	}
+}
+
+// Returns false if the request is disallowed by robots.txt. Sets the
+// crawl delay of the request context
+func (a *Architeuthis) checkRobotsTxt(rCtx *RequestCtx) (bool, error) {
+
+	hostConfig := getMostSpecificConfig(rCtx.configs)
+	if hostConfig.RobotsTxt != RobotsObey {
+		return true, nil
+	}
+
+	robots, err := a.getRobotsTxt(rCtx)
+	if err != nil {
+		return false, err
+	}
+	userAgent := hostConfig.RobotsUserAgent
+	if userAgent == "" {
+		userAgent = rCtx.Request.Header.Get("User-Agent")
+	}
+
+	rCtx.crawlDelay = robots.crawlDelay(userAgent)
+
+	return robots.isAllowed(userAgent, rCtx.Request.URL.RequestURI()), nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRobotsTxt = `
+# Comment
+User-agent: mybot
+User-agent: otherbot
+Disallow: /private   # trailing comment
+Allow: /private/public
+Crawl-delay: 2.5
+
+User-agent: *
+Disallow: /
+Allow: /page
+Disallow: /page
+Allow: /*.css$
+Disallow: /tmp/*/cache
+`
+
+func TestParseRobotsTxt(t *testing.T) {
+
+	robots := parseRobotsTxt(strings.NewReader(testRobotsTxt))
+
+	if len(robots.groups) != 2 {
+		t.Fatalf("expected 2 groups, got %d", len(robots.groups))
+	}
+
+	group := robots.groups[0]
+	if strings.Join(group.agents, ",") != "mybot,otherbot" {
+		t.Errorf("unexpected agents: %v", group.agents)
+	}
+	if len(group.rules) != 2 || group.rules[0] != (robotsRule{pattern: "/private", allow: false}) ||
+		group.rules[1] != (robotsRule{pattern: "/private/public", allow: true}) {
+		t.Errorf("unexpected rules: %v", group.rules)
+	}
+	if group.crawlDelay != 2500*time.Millisecond {
+		t.Errorf("unexpected crawl delay: %s", group.crawlDelay)
+	}
+
+	if robots.crawlDelay("Mozilla/5.0 (compatible; OtherBot/1.0)") != 2500*time.Millisecond {
+		t.Error("expected the crawl delay of otherbot")
+	}
+	if robots.crawlDelay("curl") != 0 {
+		t.Error("expected no crawl delay for *")
+	}
+}
+
+func TestRobotsPatternMatches(t *testing.T) {
+
+	tests := []struct {
+		pattern  string
+		path     string
+		expected bool
+	}{
+		{"/", "/anything", true},
+		{"/a", "/a", true},
+		{"/a", "/abc/d", true},
+		{"/a", "/b/a", false},
+		{"/*.php", "/x/y.php", true},
+		{"/*.php", "/x/y.php?q=1", true},
+		{"/*.php", "/x/y.html", false},
+		{"/*.php$", "/x/y.php", true},
+		{"/*.php$", "/x/y.php?q=1", false},
+		{"/a$", "/a", true},
+		{"/a$", "/ab", false},
+		{"/tmp/*/cache", "/tmp/x/y/cache/z", true},
+		{"/tmp/*/cache", "/tmp/cache", false},
+		{"*", "/anything", true},
+	}
+
+	for _, test := range tests {
+		if robotsPatternMatches(test.pattern, test.path) != test.expected {
+			t.Errorf("%s, %s: expected %v", test.pattern, test.path, test.expected)
+		}
+	}
+}
+
+func TestRobotsIsAllowed(t *testing.T) {
+
+	robots := parseRobotsTxt(strings.NewReader(testRobotsTxt))
+
+	tests := []struct {
+		userAgent string
+		path      string
+		expected  bool
+	}{
+		{"mybot", "/", true},
+		{"mybot", "/private/x", false},
+		// Longest match wins
+		{"mybot", "/private/public/x", true},
+		{"MyBot/2.0", "/private", false},
+		{"curl", "/", false},
+		{"curl", "/other", false},
+		// Allow wins a tie
+		{"curl", "/page", true},
+		{"curl", "/style.css", true},
+		{"curl", "/style.css?v=1", false},
+		{"curl", "/robots.txt", true},
+	}
+
+	for _, test := range tests {
+		if robots.isAllowed(test.userAgent, test.path) != test.expected {
+			t.Errorf("%s, %s: expected %v", test.userAgent, test.path, test.expected)
+		}
+	}
+
+	empty := &robotsTxt{}
+	if !empty.isAllowed("curl", "/x") {
+		t.Error("expected everything to be allowed without robots.txt")
+	}
+
+	disallowAll := &robotsTxt{disallowAll: true}
+	if disallowAll.isAllowed("curl", "/x") || !disallowAll.isAllowed("curl", "/robots.txt") {
+		t.Error("expected everything but robots.txt to be disallowed")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron"
+	"strings"
+	"time"
+)
+
+func parseScheduleEntry(raw *RawScheduleEntry) (*ScheduleEntry, error) {
+
+	entry := &ScheduleEntry{
+		Burst: raw.Burst,
+	}
+
+	loc := time.Local
+	if raw.Timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(raw.Timezone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if raw.EveryStr != "" {
+		var err error
+		entry.Every, err = time.ParseDuration(raw.EveryStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case raw.Cron != "" && raw.Time != "":
+		return nil, errors.Errorf("Schedule entry can't have both 'cron' and 'time'")
+	case raw.Cron != "":
+		sched, err := cron.ParseStandard(raw.Cron)
+		if err != nil {
+			return nil, err
+		}
+
+		// Active during every minute matched by the cron expression
+		entry.Matches = func(t time.Time) bool {
+			minute := t.In(loc).Truncate(time.Minute)
+			return sched.Next(minute.Add(-time.Second)).Equal(minute)
+		}
+	case raw.Time != "":
+		start, end, err := parseTimeRange(raw.Time)
+		if err != nil {
+			return nil, err
+		}
+
+		entry.Matches = func(t time.Time) bool {
+			t = t.In(loc)
+			now := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+				time.Duration(t.Second())*time.Second
+
+			if start <= end {
+				return now >= start && now < end
+			}
+			// Range wraps around midnight
+			return now >= start || now < end
+		}
+	default:
+		return nil, errors.Errorf("Schedule entry must have either 'cron' or 'time'")
+	}
+
+	return entry, nil
+}
+
+// Parses a time range such as 22:00-06:30, returns offsets from midnight
+func parseTimeRange(str string) (time.Duration, time.Duration, error) {
+
+	parts := strings.Split(str, "-")
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("Invalid time range: %s", str)
+	}
+
+	var offsets [2]time.Duration
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, errors.Wrap(err, fmt.Sprintf("Invalid time range: %s", str))
+		}
+		offsets[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+
+	return offsets[0], offsets[1], nil
+}
+
+// Returns the rate limit parameters that apply at this time: the first
+// matching schedule entry, or the static values
+func (conf *HostConfig) activeLimit(t time.Time) (time.Duration, int) {
+
+	for _, entry := range conf.Schedule {
+		if entry.Matches(t) {
+			every, burst := conf.Every, conf.Burst
+			if entry.Every != 0 {
+				every = entry.Every
+			}
+			if entry.Burst != 0 {
+				burst = entry.Burst
+			}
+			return every, burst
+		}
+	}
+
+	return conf.Every, conf.Burst
+}
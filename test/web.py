@@ -23,6 +23,11 @@ def echoh(text):
     })
 
 
+@app.route("/robots.txt")
+def robots():
+    return Response(response="User-agent: *\nDisallow: /403\nCrawl-delay: 2\n", mimetype="text/plain")
+
+
 @app.route("/500")
 def e500():
     return Response(status=500)
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"golang.org/x/time/rate"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Reads are at most this big, so that the buckets are drained progressively
+const ThrottleChunkSize = 32 * 1024
+
+// Response body that waits on one or more shared token buckets
+// (one token per byte) as it is read
+type throttledReader struct {
+	body    io.ReadCloser
+	ctx     context.Context
+	buckets []*rate.Limiter
+	chunk   int
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+
+	n, err := r.body.Read(p)
+	if n > 0 {
+		for _, bucket := range r.buckets {
+			if waitErr := bucket.WaitN(r.ctx, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
+	}
+	return n, err
+}
+
+func (r *throttledReader) Close() error {
+	return r.body.Close()
+}
+
+// Returns the shared bucket for this key, creating or updating it as needed
+func (a *Architeuthis) getBandwidthBucket(key string, bytesPerSec int64) *rate.Limiter {
+
+	a.bucketsMu.Lock()
+	defer a.bucketsMu.Unlock()
+
+	bucket, ok := a.buckets[key]
+	if !ok {
+		bucket = rate.NewLimiter(rate.Limit(bytesPerSec), int(bytesPerSec))
+		a.buckets[key] = bucket
+	} else if bucket.Limit() != rate.Limit(bytesPerSec) {
+		bucket.SetLimit(rate.Limit(bytesPerSec))
+		bucket.SetBurst(int(bytesPerSec))
+	}
+
+	return bucket
+}
+
+func isThrottled(rCtx *RequestCtx) bool {
+	return getMostSpecificConfig(rCtx.configs).MaxBytesPerSec > 0 || rCtx.p.MaxBytesPerSec > 0
+}
+
+// http.Client.Timeout also covers reading the body, which would cut off throttled
+// downloads. The returned client only applies the timeout to connecting and
+// waiting for the response headers
+func withoutBodyTimeout(client *http.Client) *http.Client {
+
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   client.Timeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = client.Timeout
+	transport.ResponseHeaderTimeout = client.Timeout
+
+	c := *client
+	c.Transport = transport
+	c.Timeout = 0
+	return &c
+}
+
+func (a *Architeuthis) throttleBody(rCtx *RequestCtx, body io.ReadCloser) io.ReadCloser {
+
+	reader := &throttledReader{
+		body:  body,
+		ctx:   rCtx.ctx,
+		chunk: ThrottleChunkSize,
+	}
+
+	hostConfig := getMostSpecificConfig(rCtx.configs)
+	if hostConfig.MaxBytesPerSec > 0 {
+		reader.buckets = append(reader.buckets,
+			a.getBandwidthBucket("host:"+hostConfig.Key, hostConfig.MaxBytesPerSec))
+	}
+	if rCtx.p.MaxBytesPerSec > 0 {
+		reader.buckets = append(reader.buckets,
+			a.getBandwidthBucket("proxy:"+rCtx.p.Name, rCtx.p.MaxBytesPerSec))
+	}
+
+	if len(reader.buckets) == 0 {
+		return body
+	}
+
+	for _, bucket := range reader.buckets {
+		if bucket.Burst() < reader.chunk {
+			reader.chunk = bucket.Burst()
+		}
+	}
+
+	return reader
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/base64"
 	"github.com/ryanuber/go-glob"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -16,7 +20,8 @@ func normalizeHost(host string) string {
 	return "." + host
 }
 
-func parseOptions(header *http.Header) RequestOptions {
+// connectClient is the client of the CONNECT request, for HTTPS requests
+func parseOptions(header *http.Header, connectClient string) RequestOptions {
 
 	opts := RequestOptions{}
 
@@ -26,15 +31,70 @@ func parseOptions(header *http.Header) RequestOptions {
 		opts.DoCloudflareBypass = true
 	}
 
+	opts.Client = parseProxyAuthUser(header.Get("Proxy-Authorization"))
+	header.Del("Proxy-Authorization")
+	if opts.Client == "" {
+		opts.Client = connectClient
+	}
+
+	if clientHeader := getConfig().ClientHeader; clientHeader != "" {
+		client := header.Get(clientHeader)
+		if client != "" {
+			header.Del(clientHeader)
+			opts.Client = client
+		}
+	}
+
+	opts.Priority = DefaultPriority
+	priority, err := strconv.Atoi(header.Get("X-Architeuthis-Priority"))
+	header.Del("X-Architeuthis-Priority")
+	if err == nil {
+		switch {
+		case priority < 1:
+			opts.Priority = 1
+		case priority > MaxPriority:
+			opts.Priority = MaxPriority
+		default:
+			opts.Priority = priority
+		}
+	}
+
 	return opts
 }
 
-func getConfigsMatchingHost(sHost string) []*HostConfig {
+func parseProxyAuthUser(auth string) string {
+
+	const prefix = "Basic "
+	if !strings.HasPrefix(auth, prefix) {
+		return ""
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return ""
+	}
+
+	creds := string(decoded)
+	col := strings.Index(creds, ":")
+	if col < 0 {
+		return creds
+	}
+	return creds[:col]
+}
+
+func getConfigsMatchingRequest(r *http.Request) []*HostConfig {
 
 	configs := make([]*HostConfig, 0)
 
-	for _, conf := range config.Hosts {
-		if glob.Glob(conf.Host, sHost) {
+	sHost := normalizeHost(r.Host)
+	scheme, port := requestSchemeAndPort(r)
+
+	for _, conf := range getConfig().Hosts {
+		if glob.Glob(conf.Host, sHost) &&
+			globOrEmpty(conf.Scheme, scheme) &&
+			globOrEmpty(conf.Port, port) &&
+			globOrEmpty(conf.Path, r.URL.Path) &&
+			globOrEmpty(conf.Method, r.Method) {
 			configs = append(configs, conf)
 		}
 	}
@@ -42,6 +102,75 @@ func getConfigsMatchingHost(sHost string) []*HostConfig {
 	return configs
 }
 
+func globOrEmpty(pattern, str string) bool {
+	return pattern == "" || glob.Glob(pattern, str)
+}
+
+// Port defaults to 80 or 443, depending on the scheme
+func requestSchemeAndPort(r *http.Request) (string, string) {
+
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	port := r.URL.Port()
+	if port == "" {
+		if col := strings.LastIndex(r.Host, ":"); col > 0 && !strings.HasSuffix(r.Host, "]") {
+			port = r.Host[col+1:]
+		} else if scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+	return scheme, port
+}
+
+// Whether every request matched by other is also matched by conf, used to
+// inherit settings from less specific configs
+func (conf *HostConfig) covers(other *HostConfig) bool {
+	return glob.Glob(conf.Host, other.Host) &&
+		globCovers(conf.Scheme, other.Scheme) &&
+		globCovers(conf.Port, other.Port) &&
+		globCovers(conf.Path, other.Path) &&
+		globCovers(conf.Method, other.Method)
+}
+
+func globCovers(pattern, other string) bool {
+	if pattern == "" {
+		return true
+	}
+	return other != "" && glob.Glob(pattern, other)
+}
+
+// Identifies the config in limiter keys, rule ids, logs and errors,
+// e.g. ".example.com;path=/api/*"
+func (conf *HostConfig) key() string {
+
+	key := conf.Host
+	if conf.Scheme != "" {
+		key += ";scheme=" + conf.Scheme
+	}
+	if conf.Port != "" {
+		key += ";port=" + conf.Port
+	}
+	if conf.Path != "" {
+		key += ";path=" + conf.Path
+	}
+	if conf.Method != "" {
+		key += ";method=" + conf.Method
+	}
+	return key
+}
+
+func getMostSpecificConfig(configs []*HostConfig) *HostConfig {
+	if len(configs) == 0 {
+		return getConfig().DefaultConfig
+	}
+	return configs[len(configs)-1]
+}
+
 func applyHeaders(r *http.Request, configs []*HostConfig) *http.Request {
 
 	for _, conf := range configs {
@@ -53,27 +182,156 @@ func applyHeaders(r *http.Request, configs []*HostConfig) *http.Request {
 	return r
 }
 
-func computeRules(requestCtx *RequestCtx, responseCtx ResponseCtx) (dontRetry, forceRetry bool, shouldRetry bool) {
-	dontRetry = false
-	forceRetry = false
-	shouldRetry = false
-
-	for _, conf := range requestCtx.configs {
-		for _, rule := range conf.Rules {
-			if rule.Matches(&responseCtx) {
-				switch rule.Action {
-				case DontRetry:
-					dontRetry = true
-				case ForceRetry:
-					forceRetry = true
-				case ShouldRetry:
-					shouldRetry = true
+// Rules of the matching configs in evaluation order: highest priority first,
+// then most specific config first, then in the order they were declared
+func orderedRules(configs []*HostConfig) []*HostRule {
+
+	var rules []*HostRule
+	for i := len(configs) - 1; i >= 0; i-- {
+		rules = append(rules, configs[i].Rules...)
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority > rules[j].Priority
+	})
+	return rules
+}
+
+// Evaluates the rules in order. The first matching rule of each kind wins
+// (e.g. a dont_retry rule can't be overridden by a later force_retry rule),
+// and evaluation ends after a matching rule with stop set
+func computeRules(requestCtx *RequestCtx, responseCtx *ResponseCtx) RuleResult {
+
+	result := RuleResult{}
+	decided := false
+
+	for _, rule := range orderedRules(requestCtx.configs) {
+		if !rule.Matches(responseCtx) {
+			continue
+		}
+		result.Matched = append(result.Matched, rule)
+
+		if result.Rule == nil {
+			result.Rule = rule
+		}
+
+		switch rule.Action {
+		case DontRetry, ForceRetry, ShouldRetry, FailWithStatus:
+			if decided {
+				break
+			}
+			decided = true
+			result.Rule = rule
+
+			switch rule.Action {
+			case DontRetry:
+				result.DontRetry = true
+			case ForceRetry:
+				result.ForceRetry = true
+			case ShouldRetry:
+				result.ShouldRetry = true
+			case FailWithStatus:
+				result.FailWithStatus = rule.Status
+			}
+		case BanProxy:
+			if result.BanProxy == 0 {
+				result.BanProxy = rule.Duration
+			}
+		case CooldownHost:
+			if result.CooldownHost == 0 {
+				result.CooldownHost = rule.Duration
+			}
+		case SetWait:
+			if result.Wait == 0 {
+				result.Wait = rule.Duration
+			}
+		case UseProxyTag:
+			if result.ProxyTag == "" {
+				result.ProxyTag = rule.Arg
+			}
+		}
+
+		if rule.Stop {
+			break
+		}
+	}
+
+	return result
+}
+
+// Applies the request rules of the matching configs, returns a status code
+// if the request was rejected
+func applyRequestRules(requestCtx *RequestCtx) (int, error) {
+
+	applied := make(map[*HostConfig]bool)
+
+	for {
+		for _, conf := range requestCtx.configs {
+			if applied[conf] {
+				continue
+			}
+			applied[conf] = true
+
+			status, err := applyConfigRequestRules(requestCtx, conf)
+			if err != nil || status != 0 {
+				return status, err
+			}
+		}
+
+		// A rewritten URL might match other configs, their rules are applied as well
+		configs := getConfigsMatchingRequest(requestCtx.Request)
+		requestCtx.configs = configs
+
+		done := true
+		for _, conf := range configs {
+			if !applied[conf] {
+				done = false
+			}
+		}
+		if done {
+			return 0, nil
+		}
+	}
+}
+
+func applyConfigRequestRules(requestCtx *RequestCtx, conf *HostConfig) (int, error) {
+
+	ctx := &ResponseCtx{RequestCtx: requestCtx}
+	r := requestCtx.Request
+
+	for _, rule := range conf.RequestRules {
+		if !rule.Matches(ctx) {
+			continue
+		}
+
+		switch rule.Action {
+		case Reject:
+			return rule.Status, nil
+		case RewriteUrl:
+			newUrl, err := url.Parse(rule.Pattern.ReplaceAllString(r.URL.String(), rule.Replace))
+			if err != nil {
+				return 0, err
+			}
+			r.URL = newUrl
+			r.Host = newUrl.Host
+		case StripQuery:
+			query := r.URL.Query()
+			for key := range query {
+				for _, pattern := range rule.Keys {
+					if glob.Glob(pattern, key) {
+						query.Del(key)
+					}
 				}
 			}
+			newUrl := *r.URL
+			newUrl.RawQuery = query.Encode()
+			r.URL = &newUrl
+		case UseTag:
+			requestCtx.proxyTag = rule.Arg
 		}
 	}
 
-	return
+	return 0, nil
 }
 
 func cloneRequest(r *http.Request) *http.Request {
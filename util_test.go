@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetConfigsMatchingRequest(t *testing.T) {
+
+	useTestConfig(t, `{
+		"timeout": "1s", "wait": "0s", "multiplier": 1, "retries": 1,
+		"hosts": [
+			{"host": "*", "every": "1s", "burst": 1},
+			{"host": "*.example.com"},
+			{"host": "*.example.com", "scheme": "https"},
+			{"host": "*.example.com", "port": "8080"},
+			{"host": "*.example.com", "path": "/api/*"},
+			{"host": "*.example.com", "path": "/api/*", "method": "POST"}
+		]
+	}`)
+
+	tests := []struct {
+		method   string
+		url      string
+		expected string
+	}{
+		{"GET", "http://other.com/", "*"},
+		{"GET", "http://example.com/", "*,*.example.com"},
+		{"GET", "https://www.example.com/", "*,*.example.com,*.example.com;scheme=https"},
+		{"GET", "http://example.com:8080/", "*,*.example.com,*.example.com;port=8080"},
+		// Default ports
+		{"GET", "http://example.com:80/", "*,*.example.com"},
+		{"GET", "https://example.com:8080/", "*,*.example.com,*.example.com;scheme=https,*.example.com;port=8080"},
+		{"GET", "http://example.com/api/items?page=2", "*,*.example.com,*.example.com;path=/api/*"},
+		{"GET", "http://example.com/api", "*,*.example.com"},
+		{"POST", "http://example.com/api/items", "*,*.example.com,*.example.com;path=/api/*,*.example.com;path=/api/*;method=POST"},
+		{"POST", "http://example.com/", "*,*.example.com"},
+	}
+
+	for _, test := range tests {
+		rCtx := testRequestCtx(t, test.method, test.url)
+
+		keys := make([]string, 0, len(rCtx.configs))
+		for _, conf := range rCtx.configs {
+			keys = append(keys, conf.Key)
+		}
+		if strings.Join(keys, ",") != test.expected {
+			t.Errorf("%s %s: expected %s, got %s", test.method, test.url, test.expected, strings.Join(keys, ","))
+		}
+	}
+}
+
+func TestRequestSchemeAndPort(t *testing.T) {
+
+	tests := []struct {
+		url    string
+		scheme string
+		port   string
+	}{
+		{"http://example.com/", "http", "80"},
+		{"https://example.com/", "https", "443"},
+		{"https://example.com:8443/", "https", "8443"},
+		{"http://[::1]/", "http", "80"},
+		{"http://[::1]:8080/", "http", "8080"},
+		{"//example.com/", "http", "80"},
+	}
+
+	for _, test := range tests {
+		rCtx := testRequestCtx(t, "GET", test.url)
+		scheme, port := requestSchemeAndPort(rCtx.Request)
+		if scheme != test.scheme || port != test.port {
+			t.Errorf("%s: expected %s, %s, got %s, %s", test.url, test.scheme, test.port, scheme, port)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"path/filepath"
+	"time"
+)
+
+// Editors usually write a file in several steps, wait for the last one
+const ConfigReloadDebounce = 500 * time.Millisecond
+
+// Set with the -watch-config flag
+var watchConfig = true
+
+// Reloads the config when the config file changes
+func (a *Architeuthis) setupConfigWatcher() {
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.WithError(err).Error("Could not watch config file")
+		return
+	}
+
+	// Watch the directory, the file itself is often replaced (renamed over) when it is saved
+	configFile := filepath.Clean(configPath)
+	err = watcher.Add(filepath.Dir(configFile))
+	if err != nil {
+		logrus.WithError(err).Error("Could not watch config file")
+		_ = watcher.Close()
+		return
+	}
+
+	go a.watchConfigFile(watcher, configFile)
+
+	logrus.WithFields(logrus.Fields{
+		"file": configFile,
+	}).Info("Watching config file")
+}
+
+func (a *Architeuthis) watchConfigFile(watcher *fsnotify.Watcher, configFile string) {
+
+	var timer *time.Timer
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != configFile || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(ConfigReloadDebounce, a.reloadChangedConfig)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.WithError(err).Error("Error watching config file")
+		}
+	}
+}
+
+func (a *Architeuthis) reloadChangedConfig() {
+
+	cfg, err := loadConfig()
+	if err != nil {
+		logrus.WithError(err).Error("Config file changed but could not be loaded, keeping the current config")
+		return
+	}
+
+	// Compared to the file, not to the active config: in cluster mode it is the
+	// config of the cluster, which must not be replaced by an unchanged file
+	if !a.setLocalConfig(cfg) {
+		logrus.WithField("hash", cfg.Hash).Trace("Config file changed, but not its contents")
+		return
+	}
+
+	err = a.activateConfig(cfg, "file")
+	if err != nil {
+		logrus.WithError(err).Error("Could not publish config")
+	}
+}